@@ -1,3 +1,3 @@
 module github.com/sematext/go-ntlm
 
-go 1.13
+go 1.18
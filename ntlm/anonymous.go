@@ -0,0 +1,55 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+// ErrAnonymousNotAllowed is returned by servers that get an anonymous AUTHENTICATE_MESSAGE without SetAllowAnonymous
+var ErrAnonymousNotAllowed = newError(ErrPolicyViolation, "Anonymous authentication is not allowed")
+
+// SetAnonymous makes a client authenticate anonymously. The AUTHENTICATE_MESSAGE then has no user, an empty NT
+// response and a single zero byte LM response, and the session keys are derived from a null session key.
+func (n *SessionData) SetAnonymous() {
+	n.user = ""
+	n.password = ""
+	n.userDomain = ""
+	n.ntHash = nil
+	n.lmHash = nil
+	n.anonymous = true
+}
+
+// SetAllowAnonymous controls if a server accepts anonymous clients. It is off by default.
+func (n *SessionData) SetAllowAnonymous(allow bool) {
+	n.allowAnonymous = allow
+}
+
+// IsAnonymous tells if the client of a server session authenticated anonymously
+func (n *SessionData) IsAnonymous() bool {
+	return n.anonymous
+}
+
+// Sets the responses of an anonymous client, its session keys are derived from a null session key
+func (n *SessionData) anonymousResponses() {
+	n.NegotiateFlags = NTLMSSP_ANONYMOUS.Set(n.NegotiateFlags)
+	n.ntChallengeResponse = make([]byte, 0)
+	n.lmChallengeResponse = zeroBytes(1)
+	n.sessionBaseKey = zeroBytes(16)
+	n.keyExchangeKey = zeroBytes(16)
+}
+
+// Accepts an anonymous AUTHENTICATE_MESSAGE on a server, the session keys are derived from a null session key
+func (n *SessionData) acceptAnonymous() error {
+	if !n.allowAnonymous {
+		return ErrAnonymousNotAllowed
+	}
+
+	err := n.checkChannelBindings(nil)
+	if err != nil {
+		return err
+	}
+
+	n.anonymous = true
+	n.user = ""
+	n.userDomain = ""
+	n.sessionBaseKey = zeroBytes(16)
+	n.keyExchangeKey = zeroBytes(16)
+	return nil
+}
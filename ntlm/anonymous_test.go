@@ -0,0 +1,82 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNTLMv2Anonymous(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		client := new(V2ClientSession)
+		client.SetAnonymous()
+		server := new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		server.SetAllowAnonymous(allow)
+
+		am, err := runV2Handshake(t, client, server, true)
+		if !allow {
+			if err != ErrAnonymousNotAllowed {
+				t.Errorf("Expected anonymous not allowed error got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Could not authenticate anonymously: %s", err)
+		}
+
+		if am.UserName.Len != 0 || am.NtChallengeResponseFields.Len != 0 || !bytes.Equal(am.LmChallengeResponse.Payload, []byte{0}) {
+			t.Error("Authenticate message is not in the anonymous form")
+		}
+		if !NTLMSSP_ANONYMOUS.IsSet(am.NegotiateFlags) {
+			t.Error("Anonymous flag should be set")
+		}
+		if !server.IsAnonymous() {
+			t.Error("Server should report an anonymous client")
+		}
+
+		sealed, signature, err := client.SealDatagram([]byte("Plaintext"), 0)
+		if err != nil {
+			t.Fatalf("Could not seal message: %s", err)
+		}
+		plaintext, err := server.UnsealDatagram(sealed, signature, 0)
+		if err != nil || string(plaintext) != "Plaintext" {
+			t.Errorf("Server could not unseal anonymous client message: %s", err)
+		}
+	}
+
+	// A regular client on the same kind of server is not anonymous
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetAllowAnonymous(true)
+	if _, err := runV2Handshake(t, client, server, true); err != nil || server.IsAnonymous() {
+		t.Errorf("Regular client should authenticate and not be anonymous: %v", err)
+	}
+}
+
+func TestNTLMv1Anonymous(t *testing.T) {
+	server := new(V1ServerSession)
+	server.SetAllowAnonymous(true)
+	challenge, _ := server.GenerateChallengeMessage()
+
+	client := new(V1ClientSession)
+	client.SetAnonymous()
+	err := client.ProcessChallengeMessage(challenge)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+	am, _ := client.GenerateAuthenticateMessage()
+	am, err = ParseAuthenticateMessage(am.Bytes(), 1)
+	if err != nil {
+		t.Fatalf("Could not parse anonymous authenticate message: %s", err)
+	}
+
+	err = server.ProcessAuthenticateMessage(am)
+	if err != nil || !server.IsAnonymous() {
+		t.Errorf("Could not authenticate anonymously: %v", err)
+	}
+	checkV1Value(t, "Session base key", server.sessionBaseKey, "00000000000000000000000000000000", nil)
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"time"
 )
 
 type AvPairType uint16
@@ -41,6 +42,53 @@ const (
 	MsvChannelBindings
 )
 
+// The names that current versions of MS-NLMP use for MsAvRestrictions and MsvChannelBindings
+const (
+	MsvAvSingleHost      = MsAvRestrictions
+	MsvAvChannelBindings = MsvChannelBindings
+)
+
+var avPairTypeNames = map[AvPairType]string{
+	MsvAvEOL:             "MsvAvEOL",
+	MsvAvNbComputerName:  "MsvAvNbComputerName",
+	MsvAvNbDomainName:    "MsvAvNbDomainName",
+	MsvAvDnsComputerName: "MsvAvDnsComputerName",
+	MsvAvDnsDomainName:   "MsvAvDnsDomainName",
+	MsvAvDnsTreeName:     "MsvAvDnsTreeName",
+	MsvAvFlags:           "MsvAvFlags",
+	MsvAvTimestamp:       "MsvAvTimestamp",
+	MsvAvSingleHost:      "MsvAvSingleHost",
+	MsvAvTargetName:      "MsvAvTargetName",
+	MsvAvChannelBindings: "MsvAvChannelBindings",
+}
+
+func (t AvPairType) String() string {
+	if name, ok := avPairTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("AvPairType(0x%04x)", uint16(t))
+}
+
+// AvFlags is the 32-bit value of the MsvAvFlags AV_PAIR
+type AvFlags uint32
+
+const (
+	// The account authentication is constrained
+	AvFlagAccountConstrained AvFlags = 0x00000001
+	// The client is providing message integrity in the MIC field of the AUTHENTICATE_MESSAGE
+	AvFlagMicProvided AvFlags = 0x00000002
+	// The client is providing a target SPN generated from an untrusted source
+	AvFlagUntrustedSPN AvFlags = 0x00000004
+)
+
+func (f AvFlags) Set(flags AvFlags) AvFlags {
+	return flags | f
+}
+
+func (f AvFlags) IsSet(flags AvFlags) bool {
+	return (flags & f) != 0
+}
+
 // Helper struct that contains a list of AvPairs with helper methods for running through them
 type AvPairs struct {
 	List []AvPair
@@ -51,21 +99,35 @@ func (p *AvPairs) AddAvPair(avId AvPairType, bytes []byte) {
 	p.List = append(p.List, *a)
 }
 
-func ReadAvPairs(data []byte) *AvPairs {
+// ReadAvPairs reads AvPairs until MsvAvEOL, pairs of types this package does not know are kept. Every type may
+// only be present once and a list that is not empty must end with MsvAvEOL.
+func ReadAvPairs(data []byte) (*AvPairs, error) {
 	pairs := new(AvPairs)
+	present := make(map[AvPairType]bool)
 
-	// Get the number of AvPairs and allocate enough AvPair structures to hold them
+	// There is no limit on the number of AvPairs, the list ends with MsvAvEOL
 	offset := 0
-	for i := 0; len(data) > 0 && i < 11; i++ {
-		pair := ReadAvPair(data, offset)
+	for offset < len(data) {
+		pair, err := ReadAvPair(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if present[pair.AvId] {
+			return nil, newError(ErrMalformedMessage, fmt.Sprintf("AV_PAIR %s is present more than once", pair.AvId))
+		}
+		present[pair.AvId] = true
+
 		offset = offset + 4 + int(pair.AvLen)
 		pairs.List = append(pairs.List, *pair)
 		if pair.AvId == MsvAvEOL {
-			break
+			return pairs, nil
 		}
 	}
 
-	return pairs
+	if len(pairs.List) > 0 {
+		return nil, newError(ErrMalformedMessage, "AV_PAIR list does not end with MsvAvEOL")
+	}
+	return pairs, nil
 }
 
 func (p *AvPairs) Bytes() (result []byte) {
@@ -124,6 +186,61 @@ func (p *AvPairs) StringValue(avType AvPairType) (result string) {
 	return
 }
 
+// SetOrReplace sets the value of the pair of a type, a new pair is added before MsvAvEOL
+func (p *AvPairs) SetOrReplace(avId AvPairType, value []byte) {
+	for i := range p.List {
+		if p.List[i].AvId == avId {
+			p.List[i] = AvPair{AvId: avId, AvLen: uint16(len(value)), Value: value}
+			return
+		}
+	}
+
+	if len(p.List) > 0 && p.List[len(p.List)-1].AvId == MsvAvEOL {
+		eol := p.List[len(p.List)-1]
+		p.List = p.List[:len(p.List)-1]
+		p.AddAvPair(avId, value)
+		p.List = append(p.List, eol)
+		return
+	}
+	p.AddAvPair(avId, value)
+}
+
+// Remove removes the pair of a type
+func (p *AvPairs) Remove(avId AvPairType) {
+	for i := range p.List {
+		if p.List[i].AvId == avId {
+			p.List = append(p.List[:i], p.List[i+1:]...)
+			return
+		}
+	}
+}
+
+// Flags returns the value of MsvAvFlags, or 0 when there are no flags
+func (p *AvPairs) Flags() AvFlags {
+	value := p.ByteValue(MsvAvFlags)
+	if len(value) != 4 {
+		return 0
+	}
+	return AvFlags(binary.LittleEndian.Uint32(value))
+}
+
+func (p *AvPairs) SetFlags(flags AvFlags) {
+	p.SetOrReplace(MsvAvFlags, uint32ToBytes(uint32(flags)))
+}
+
+// Timestamp returns the time of MsvAvTimestamp, or the zero time when there is no timestamp
+func (p *AvPairs) Timestamp() time.Time {
+	value := p.ByteValue(MsvAvTimestamp)
+	if len(value) != 8 {
+		return time.Time{}
+	}
+	return windowsFileTimeToTime(value)
+}
+
+func (p *AvPairs) SetTimestamp(t time.Time) {
+	p.SetOrReplace(MsvAvTimestamp, timeToWindowsFileTime(t))
+}
+
 // AvPair as described by MS-NLMP
 type AvPair struct {
 	AvId  AvPairType
@@ -131,12 +248,19 @@ type AvPair struct {
 	Value []byte
 }
 
-func ReadAvPair(data []byte, offset int) *AvPair {
+func ReadAvPair(data []byte, offset int) (*AvPair, error) {
+	if offset < 0 || offset+4 > len(data) {
+		return nil, newError(ErrMalformedMessage, "AV_PAIR header is outside of the data")
+	}
+
 	pair := new(AvPair)
 	pair.AvId = AvPairType(binary.LittleEndian.Uint16(data[offset : offset+2]))
 	pair.AvLen = binary.LittleEndian.Uint16(data[offset+2 : offset+4])
+	if offset+4+int(pair.AvLen) > len(data) {
+		return nil, newError(ErrMalformedMessage, "AV_PAIR value is outside of the data")
+	}
 	pair.Value = data[offset+4 : offset+4+int(pair.AvLen)]
-	return pair
+	return pair, nil
 }
 
 func (a *AvPair) UnicodeStringValue() string {
@@ -174,13 +298,17 @@ func (a *AvPair) String() string {
 	case MsvAvTimestamp:
 		outString = "MsvAvTimestamp: " + hex.EncodeToString(a.Value)
 	case MsAvRestrictions:
-		outString = "MsAvRestrictions: " + hex.EncodeToString(a.Value)
+		if singleHost, err := ReadSingleHostData(a.Value); err == nil {
+			outString = "MsvAvSingleHost: " + singleHost.String()
+		} else {
+			outString = "MsvAvSingleHost: " + hex.EncodeToString(a.Value)
+		}
 	case MsvAvTargetName:
 		outString = "MsvAvTargetName: " + a.UnicodeStringValue()
 	case MsvChannelBindings:
 		outString = "MsvChannelBindings: " + hex.EncodeToString(a.Value)
 	default:
-		outString = fmt.Sprintf("unknown pair type: '%d'", a.AvId)
+		outString = fmt.Sprintf("%s: %s", a.AvId, hex.EncodeToString(a.Value))
 	}
 
 	return outString
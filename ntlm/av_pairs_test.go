@@ -0,0 +1,89 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReadAvPairsInvalid(t *testing.T) {
+	duplicate := new(AvPairs)
+	duplicate.AddAvPair(MsvAvNbDomainName, utf16FromString("DOMAIN"))
+	duplicate.AddAvPair(MsvAvNbDomainName, utf16FromString("OTHER"))
+	duplicate.AddAvPair(MsvAvEOL, nil)
+
+	missingEOL := new(AvPairs)
+	missingEOL.AddAvPair(MsvAvNbDomainName, utf16FromString("DOMAIN"))
+
+	for name, pairs := range map[string]*AvPairs{"duplicate": duplicate, "missing EOL": missingEOL} {
+		if _, err := ReadAvPairs(pairs.Bytes()); !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("Expected an error for the %s AvPairs got %v", name, err)
+		}
+	}
+
+	if pairs, err := ReadAvPairs(nil); err != nil || len(pairs.List) != 0 {
+		t.Errorf("Empty AvPairs should be read without an error got %v", err)
+	}
+}
+
+func TestAvPairsTypedValues(t *testing.T) {
+	pairs := new(AvPairs)
+	pairs.AddAvPair(MsvAvNbDomainName, utf16FromString("DOMAIN"))
+	pairs.AddAvPair(MsvAvEOL, nil)
+
+	if pairs.Flags() != 0 || !pairs.Timestamp().IsZero() {
+		t.Error("Flags and timestamp should be empty")
+	}
+
+	timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pairs.SetTimestamp(timestamp)
+	pairs.SetFlags(AvFlagMicProvided)
+	pairs.SetFlags(AvFlagUntrustedSPN.Set(pairs.Flags()))
+	pairs.SetOrReplace(MsvAvNbDomainName, utf16FromString("OTHER"))
+
+	read, err := ReadAvPairs(pairs.Bytes())
+	if err != nil {
+		t.Fatalf("Could not read AvPairs: %s", err)
+	}
+	if len(read.List) != 4 || read.List[3].AvId != MsvAvEOL {
+		t.Errorf("New pairs should be added before MsvAvEOL got %s", read)
+	}
+	if !read.Timestamp().Equal(timestamp) {
+		t.Errorf("Expected timestamp %s got %s", timestamp, read.Timestamp())
+	}
+	if flags := read.Flags(); !AvFlagMicProvided.IsSet(flags) || !AvFlagUntrustedSPN.IsSet(flags) || AvFlagAccountConstrained.IsSet(flags) {
+		t.Errorf("Flags are not correct got 0x%08x", uint32(flags))
+	}
+	if read.StringValue(MsvAvNbDomainName) != "OTHER" {
+		t.Errorf("Domain should be replaced got %s", read.StringValue(MsvAvNbDomainName))
+	}
+
+	read.Remove(MsvAvTimestamp)
+	if read.Find(MsvAvTimestamp) != nil || len(read.List) != 3 {
+		t.Error("Timestamp should be removed")
+	}
+
+	if MsvAvSingleHost.String() != "MsvAvSingleHost" || AvPairType(0x1234).String() != "AvPairType(0x1234)" {
+		t.Error("AvPairType names are not correct")
+	}
+}
+
+func TestReadAvPairsMoreThanEleven(t *testing.T) {
+	pairs := new(AvPairs)
+	// Vendor specific types are kept
+	for i := 0; i < 12; i++ {
+		pairs.AddAvPair(AvPairType(0x100+i), utf16FromString("COMPUTER"))
+	}
+	pairs.AddAvPair(MsvAvTimestamp, make([]byte, 8))
+	pairs.AddAvPair(MsvAvEOL, nil)
+
+	read, err := ReadAvPairs(pairs.Bytes())
+	if err != nil {
+		t.Fatalf("Could not read AvPairs: %s", err)
+	}
+	if len(read.List) != 14 || read.Find(MsvAvTimestamp) == nil {
+		t.Errorf("Expected all 14 AvPairs to be read got %d", len(read.List))
+	}
+}
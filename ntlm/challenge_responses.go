@@ -5,7 +5,6 @@ package ntlm
 import (
 	"bytes"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
@@ -21,6 +20,9 @@ func (n *NtlmV1Response) String() string {
 }
 
 func ReadNtlmV1Response(bytes []byte) (*NtlmV1Response, error) {
+	if len(bytes) < 24 {
+		return nil, newError(ErrMalformedMessage, "NTLM v1 response must be 24 bytes")
+	}
 	r := new(NtlmV1Response)
 	r.Response = bytes[0:24]
 	return r, nil
@@ -84,6 +86,9 @@ func (n *NtlmV2Response) String() string {
 }
 
 func ReadNtlmV2Response(bytes []byte) (*NtlmV2Response, error) {
+	if len(bytes) < 44 {
+		return nil, newError(ErrMalformedMessage, "NTLM v2 response is too short to contain a client challenge")
+	}
 	r := new(NtlmV2Response)
 	r.Response = bytes[0:16]
 	r.NtlmV2ClientChallenge = new(NtlmV2ClientChallenge)
@@ -92,7 +97,7 @@ func ReadNtlmV2Response(bytes []byte) (*NtlmV2Response, error) {
 	c.HiRespType = bytes[17]
 
 	if c.RespType != 1 || c.HiRespType != 1 {
-		return nil, errors.New("Does not contain a valid NTLM v2 client challenge - could be NTLMv1.")
+		return nil, newError(ErrMalformedMessage, "Does not contain a valid NTLM v2 client challenge - could be NTLMv1.")
 	}
 
 	// Ignoring - 2 bytes reserved
@@ -103,7 +108,11 @@ func ReadNtlmV2Response(bytes []byte) (*NtlmV2Response, error) {
 	c.ChallengeFromClient = bytes[32:40]
 	// Ignoring - 4 bytes reserved
 	// c.Reserved3
-	c.AvPairs = ReadAvPairs(bytes[44:])
+	var err error
+	c.AvPairs, err = ReadAvPairs(bytes[44:])
+	if err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
@@ -114,10 +123,13 @@ type LmV1Response struct {
 	Response []byte
 }
 
-func ReadLmV1Response(bytes []byte) *LmV1Response {
+func ReadLmV1Response(bytes []byte) (*LmV1Response, error) {
+	if len(bytes) < 24 {
+		return nil, newError(ErrMalformedMessage, "LM v1 response must be 24 bytes")
+	}
 	r := new(LmV1Response)
 	r.Response = bytes[0:24]
-	return r
+	return r, nil
 }
 
 func (l *LmV1Response) String() string {
@@ -136,11 +148,14 @@ type LmV2Response struct {
 	ChallengeFromClient []byte
 }
 
-func ReadLmV2Response(bytes []byte) *LmV2Response {
+func ReadLmV2Response(bytes []byte) (*LmV2Response, error) {
+	if len(bytes) < 24 {
+		return nil, newError(ErrMalformedMessage, "LM v2 response must be 24 bytes")
+	}
 	r := new(LmV2Response)
 	r.Response = bytes[0:16]
 	r.ChallengeFromClient = bytes[16:24]
-	return r
+	return r, nil
 }
 
 func (l *LmV2Response) String() string {
@@ -0,0 +1,104 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+
+	// Register the hash functions that can be used for tls-server-end-point bindings
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// ChannelBindingPolicy tells a server how to handle the MsvChannelBindings AV_PAIR of NTLMv2 clients. These are the
+// Extended Protection for Authentication settings of Windows.
+type ChannelBindingPolicy int
+
+const (
+	// The channel bindings of the client are not checked
+	ChannelBindingOff ChannelBindingPolicy = iota
+	// Clients that send channel bindings must send the expected ones, clients that do not send them are accepted
+	ChannelBindingAllow
+	// Every client must send the expected channel bindings
+	ChannelBindingRequire
+)
+
+// ChannelBindings holds the fields of a gss_channel_bindings_struct (RFC 2744 section 3.11). The MD5 hash of the
+// serialized structure is sent by NTLMv2 clients in the MsvChannelBindings AV_PAIR so that servers using Extended
+// Protection can check that the authentication happened over the same TLS channel.
+type ChannelBindings struct {
+	InitiatorAddrType uint32
+	InitiatorAddress  []byte
+	AcceptorAddrType  uint32
+	AcceptorAddress   []byte
+	ApplicationData   []byte
+}
+
+// TLSServerEndPointBindings creates the tls-server-end-point channel bindings (RFC 5929 section 4) for the
+// certificate of the TLS server. This is the binding type used by IIS with Extended Protection enabled.
+func TLSServerEndPointBindings(cert *x509.Certificate) *ChannelBindings {
+	// The hash function of the certificate signature is used, except that MD5 and SHA-1 are replaced by SHA-256
+	hash := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	}
+
+	h := hash.New()
+	h.Write(cert.Raw)
+	return &ChannelBindings{ApplicationData: concat([]byte("tls-server-end-point:"), h.Sum(nil))}
+}
+
+// Bytes returns the gss_channel_bindings_struct in the form that is hashed: every address type and length is
+// written as a little endian 32 bit value followed by the value itself.
+func (c *ChannelBindings) Bytes() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, c.InitiatorAddrType)
+	binary.Write(buffer, binary.LittleEndian, uint32(len(c.InitiatorAddress)))
+	buffer.Write(c.InitiatorAddress)
+	binary.Write(buffer, binary.LittleEndian, c.AcceptorAddrType)
+	binary.Write(buffer, binary.LittleEndian, uint32(len(c.AcceptorAddress)))
+	buffer.Write(c.AcceptorAddress)
+	binary.Write(buffer, binary.LittleEndian, uint32(len(c.ApplicationData)))
+	buffer.Write(c.ApplicationData)
+	return buffer.Bytes()
+}
+
+// Hash returns the MD5 hash of the channel bindings as it is sent in the MsvChannelBindings AV_PAIR
+func (c *ChannelBindings) Hash() []byte {
+	return md5(c.Bytes())
+}
+
+// Checks the MsvChannelBindings of the client against the channel bindings set on the server. A missing or all-zero
+// hash means the client did not send channel bindings. pairs is nil for NTLMv1, which cannot carry them.
+func (n *SessionData) checkChannelBindings(pairs *AvPairs) error {
+	if n.channelBindingPolicy == ChannelBindingOff {
+		return nil
+	}
+
+	expected := zeroBytes(16)
+	if n.channelBindings != nil {
+		expected = n.channelBindings.Hash()
+	}
+
+	var hash []byte
+	if pairs != nil {
+		hash = pairs.ByteValue(MsvChannelBindings)
+	}
+	if len(hash) == 0 || bytes.Equal(hash, zeroBytes(16)) {
+		if n.channelBindingPolicy == ChannelBindingRequire {
+			return newError(ErrChannelBindingMismatch, "Authenticate message is missing the channel bindings")
+		}
+		return nil
+	}
+
+	if !bytes.Equal(hash, expected) {
+		return ErrChannelBindingMismatch
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestChannelBindingsHash(t *testing.T) {
+	empty := new(ChannelBindings)
+	checkV2Value(t, "Empty channel bindings hash", empty.Hash(), "441018525208457705bf09a8ee3c1093", nil)
+
+	applicationData := make([]byte, 32)
+	for i := range applicationData {
+		applicationData[i] = byte(i)
+	}
+	bindings := &ChannelBindings{ApplicationData: concat([]byte("tls-server-end-point:"), applicationData)}
+	checkV2Value(t, "Channel bindings hash", bindings.Hash(), "8f1214c9c9cab8dc3bf866da9aba57a7", nil)
+}
+
+func TestTLSServerEndPointBindings(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	hash := sha256.Sum256(cert.Raw)
+	bindings := TLSServerEndPointBindings(cert)
+	expected := concat([]byte("tls-server-end-point:"), hash[:])
+	if !bytes.Equal(bindings.ApplicationData, expected) {
+		t.Errorf("Application data not correct expected %s got %s", hex.EncodeToString(expected), hex.EncodeToString(bindings.ApplicationData))
+	}
+}
+
+func TestNTLMv2ClientChannelBindings(t *testing.T) {
+	bindings := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:certificate hash")}
+
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	client.SetChannelBindings(bindings)
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	pairs := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs
+	if !bytes.Equal(pairs.ByteValue(MsvChannelBindings), bindings.Hash()) {
+		t.Errorf("Client did not send the channel bindings hash got %s", hex.EncodeToString(pairs.ByteValue(MsvChannelBindings)))
+	}
+	if pairs.List[len(pairs.List)-1].AvId != MsvAvEOL {
+		t.Error("Client AvPairs should end with MsvAvEOL")
+	}
+}
+
+func TestNTLMv2ServerChannelBindingPolicy(t *testing.T) {
+	bindings := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:certificate hash")}
+	other := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:other hash")}
+
+	tests := []struct {
+		policy  ChannelBindingPolicy
+		client  *ChannelBindings
+		success bool
+	}{
+		{ChannelBindingOff, nil, true},
+		{ChannelBindingOff, other, true},
+		{ChannelBindingAllow, nil, true},
+		{ChannelBindingAllow, bindings, true},
+		{ChannelBindingAllow, other, false},
+		{ChannelBindingRequire, nil, false},
+		{ChannelBindingRequire, bindings, true},
+		{ChannelBindingRequire, other, false},
+	}
+
+	for _, test := range tests {
+		client := new(V2ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		client.SetChannelBindings(test.client)
+		server := new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		server.SetChannelBindings(bindings)
+		server.SetChannelBindingPolicy(test.policy)
+
+		_, err := runV2Handshake(t, client, server, true)
+		if (err == nil) != test.success {
+			t.Errorf("Policy %d with client bindings %v: expected success %t got error %v", test.policy, test.client, test.success, err)
+		}
+	}
+}
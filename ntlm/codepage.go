@@ -0,0 +1,121 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+// CodePage is an OEM code page, the single byte character set that is used for the names in NTLM messages when
+// NTLMSSP_NEGOTIATE_UNICODE is not negotiated. The lower half is ASCII, the upper half is specific to the code page.
+type CodePage struct {
+	name   string
+	decode [128]rune
+	encode map[rune]byte
+}
+
+var (
+	// CodePage437 is the OEM code page of US English Windows systems, it is used when no other code page is set
+	CodePage437 = newCodePage("CP437", ""+
+		"ÇüéâäàåçêëèïîìÄÅ"+
+		"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ"+
+		"áíóúñÑªº¿⌐¬½¼¡«»"+
+		"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐"+
+		"└┴┬├─┼╞╟╚╔╩╦╠═╬╧"+
+		"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀"+
+		"αßΓπΣσµτΦΘΩδ∞φε∩"+
+		"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0")
+	// CodePage850 is the OEM code page of most Western European Windows systems
+	CodePage850 = newCodePage("CP850", ""+
+		"ÇüéâäàåçêëèïîìÄÅ"+
+		"ÉæÆôöòûùÿÖÜø£Ø×ƒ"+
+		"áíóúñÑªº¿®¬½¼¡«»"+
+		"░▒▓│┤ÁÂÀ©╣║╗╝¢¥┐"+
+		"└┴┬├─┼ãÃ╚╔╩╦╠═╬¤"+
+		"ðÐÊËÈıÍÎÏ┘┌█▄¦Ì▀"+
+		"ÓßÔÒõÕµþÞÚÛÙýÝ¯´"+
+		"\u00ad±‗¾¶§÷¸°¨·¹³²■\u00a0")
+)
+
+// Creates a code page from the characters of the bytes 0x80 to 0xFF
+func newCodePage(name string, upperHalf string) *CodePage {
+	c := &CodePage{name: name, encode: make(map[rune]byte)}
+	i := 0
+	for _, r := range upperHalf {
+		c.decode[i] = r
+		c.encode[r] = byte(0x80 + i)
+		i++
+	}
+	if i != 128 {
+		panic("Code page " + name + " must have 128 characters in its upper half")
+	}
+	return c
+}
+
+func (c *CodePage) Name() string {
+	return c.name
+}
+
+// Encode converts a string to the code page, characters that are not in the code page are replaced with '?' like
+// Windows does
+func (c *CodePage) Encode(s string) []byte {
+	result := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < 0x80 {
+			result = append(result, byte(r))
+		} else if b, ok := c.encode[r]; ok {
+			result = append(result, b)
+		} else {
+			result = append(result, '?')
+		}
+	}
+	return result
+}
+
+// Decode converts bytes in the code page to a string
+func (c *CodePage) Decode(bytes []byte) string {
+	result := make([]rune, 0, len(bytes))
+	for _, b := range bytes {
+		if b < 0x80 {
+			result = append(result, rune(b))
+		} else {
+			result = append(result, c.decode[b-0x80])
+		}
+	}
+	return string(result)
+}
+
+// SetOemCodePage sets the code page of the names in the messages of the session when NTLMSSP_NEGOTIATE_UNICODE is
+// not negotiated, the default is CodePage437
+func (n *SessionData) SetOemCodePage(codePage *CodePage) {
+	n.codePage = codePage
+}
+
+func (n *SessionData) oemCodePage() *CodePage {
+	if n.codePage != nil {
+		return n.codePage
+	}
+	return CodePage437
+}
+
+// Returns true when the names in the messages are OEM strings instead of unicode
+func isOemOnly(flags uint32) bool {
+	return !NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags) && NTLM_NEGOTIATE_OEM.IsSet(flags)
+}
+
+// Creates the payload of a name in the character set that was negotiated, unicode unless only OEM was negotiated
+func (n *SessionData) createStringPayload(value string, flags uint32) *PayloadStruct {
+	if isOemOnly(flags) {
+		return n.createOemStringPayload(value)
+	}
+	p, _ := CreateStringPayload(value)
+	return p
+}
+
+func (n *SessionData) createOemStringPayload(value string) *PayloadStruct {
+	return createOemStringPayload(value, n.oemCodePage())
+}
+
+// Returns the string value of a name payload, decoding OEM strings with the code page of the session
+func (n *SessionData) payloadString(p *PayloadStruct) string {
+	if p.Type == OemStringPayload {
+		return n.oemCodePage().Decode(p.Payload)
+	}
+	return p.String()
+}
@@ -0,0 +1,63 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodePages(t *testing.T) {
+	tests := []struct {
+		codePage *CodePage
+		value    string
+		encoded  []byte
+	}{
+		{CodePage437, "Jürgen", []byte{'J', 0x81, 'r', 'g', 'e', 'n'}},
+		{CodePage437, "Ø", []byte{'?'}},
+		{CodePage850, "Søren", []byte{'S', 0x9b, 'r', 'e', 'n'}},
+		{CodePage850, "ÁÂÀ", []byte{0xb5, 0xb6, 0xb7}},
+	}
+
+	for _, test := range tests {
+		encoded := test.codePage.Encode(test.value)
+		if !bytes.Equal(encoded, test.encoded) {
+			t.Errorf("%s: expected %q to encode to %x got %x", test.codePage.Name(), test.value, test.encoded, encoded)
+		}
+		if test.encoded[0] != '?' && test.codePage.Decode(encoded) != test.value {
+			t.Errorf("%s: expected %x to decode to %q got %q", test.codePage.Name(), encoded, test.value, test.codePage.Decode(encoded))
+		}
+	}
+}
+
+func TestNTLMv2OemClient(t *testing.T) {
+	flags := NTLMSSP_NEGOTIATE_UNICODE.Unset(defaultV2ClientFlags())
+
+	client := new(V2ClientSession)
+	client.SetRequestedFlags(flags)
+	client.SetOemCodePage(CodePage850)
+	client.SetUserInfo("Søren", "Password", "Domäne", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetOemCodePage(CodePage850)
+	server.SetUserInfo("Søren", "Password", "Domäne", "")
+	server.SetServerConfig(&ServerConfig{TargetName: "DOMÄNE", TargetType: NTLMSSP_TARGET_TYPE_DOMAIN})
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("OEM client could not authenticate: %s", err)
+	}
+
+	if NTLMSSP_NEGOTIATE_UNICODE.IsSet(am.NegotiateFlags) || !NTLM_NEGOTIATE_OEM.IsSet(am.NegotiateFlags) {
+		t.Error("Only OEM should be negotiated")
+	}
+	if am.UserName.Type != OemStringPayload || !bytes.Equal(am.UserName.Payload, CodePage850.Encode("Søren")) {
+		t.Errorf("User name should be an OEM string got %x", am.UserName.Payload)
+	}
+	if user, _, domain, _ := server.GetUserInfo(); user != "Søren" || domain != "Domäne" {
+		t.Errorf("Server decoded the wrong user %q and domain %q", user, domain)
+	}
+
+	if server.challengeMessage.TargetName.Type != OemStringPayload || server.challengeMessage.TargetName.Len != 6 {
+		t.Errorf("Target name should be an OEM string got %s", server.challengeMessage.TargetName)
+	}
+}
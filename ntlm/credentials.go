@@ -0,0 +1,72 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+var (
+	// ErrUserNotFound is returned by a CredentialProvider when it does not know the user
+	ErrUserNotFound = &Error{Status: STATUS_NO_SUCH_USER, Message: "User was not found", Err: ErrLogonFailure}
+	// ErrAccountDisabled is returned by a CredentialProvider when the account of the user can not be used
+	ErrAccountDisabled = &Error{Status: STATUS_ACCOUNT_DISABLED, Message: "User account is disabled", Err: ErrLogonFailure}
+	// ErrInvalidHash is returned for an NT or LM hash that is not 16 bytes
+	ErrInvalidHash = &Error{Status: STATUS_INVALID_PARAMETER, Message: "Password hash must be 16 bytes"}
+)
+
+// CredentialProvider looks up the credentials of the user a client authenticates as, so that a server can verify
+// many users without knowing their passwords. The user and domain are the ones from the AUTHENTICATE_MESSAGE.
+type CredentialProvider interface {
+	// NTHash returns the NT hash of the password of the user, or ErrUserNotFound or ErrAccountDisabled
+	NTHash(user, domain string) ([]byte, error)
+}
+
+// CredentialProviderFunc lets an ordinary function be used as a CredentialProvider
+type CredentialProviderFunc func(user, domain string) ([]byte, error)
+
+func (f CredentialProviderFunc) NTHash(user, domain string) ([]byte, error) {
+	return f(user, domain)
+}
+
+// NTHash returns the NT hash of a password, the MD4 of its UTF-16 encoding. This is the value a CredentialProvider
+// returns and the one Windows stores for an account.
+func NTHash(password string) []byte {
+	return ntowfv1(password)
+}
+
+// LMHash returns the LM hash of a password. It is only used by NTLMv1 and only for passwords of up to 14 characters.
+func LMHash(password string) ([]byte, error) {
+	return lmowfv1(password)
+}
+
+// Checks the hashes passed to SetUserHash, the LM hash is optional
+func checkUserHash(ntHash []byte, lmHash []byte) error {
+	if len(ntHash) != 16 {
+		return newError(ErrInvalidHash, "NT hash must be 16 bytes")
+	}
+	if lmHash != nil && len(lmHash) != 16 {
+		return newError(ErrInvalidHash, "LM hash must be 16 bytes")
+	}
+	return nil
+}
+
+// SetCredentialProvider sets where a server looks up the NT hash of the user from the AUTHENTICATE_MESSAGE. Without
+// a provider the password from SetUserInfo is used.
+func (n *SessionData) SetCredentialProvider(provider CredentialProvider) {
+	n.credentials = provider
+}
+
+// Looks up the NT hash of the user of the AUTHENTICATE_MESSAGE when the server has a CredentialProvider
+func (n *SessionData) lookupCredentials() error {
+	if n.credentials == nil {
+		return nil
+	}
+
+	hash, err := n.credentials.NTHash(n.user, n.userDomain)
+	if err != nil {
+		return err
+	}
+	if len(hash) != 16 {
+		return newError(ErrInvalidHash, "Credential provider returned an NT hash that is not 16 bytes")
+	}
+	n.ntHash = hash
+	n.lmHash = nil
+	return nil
+}
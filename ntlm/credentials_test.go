@@ -0,0 +1,166 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func testCredentials(user, domain string) ([]byte, error) {
+	switch user {
+	case "User":
+		return NTHash("Password"), nil
+	case "Disabled":
+		return nil, ErrAccountDisabled
+	}
+	return nil, ErrUserNotFound
+}
+
+func TestNTHash(t *testing.T) {
+	// Sample value from 4.2.2.1.2 NTOWFv1()
+	checkV1Value(t, "NTHash", NTHash("Password"), "a4f49c406510bdcab6824ee7c30fd852", nil)
+}
+
+func TestNTLMv2CredentialProvider(t *testing.T) {
+	tests := []struct {
+		user     string
+		password string
+		err      error
+	}{
+		{"User", "Password", nil},
+		{"User", "Wrong", nil},
+		{"Disabled", "Password", ErrAccountDisabled},
+		{"Unknown", "Password", ErrUserNotFound},
+	}
+
+	for _, test := range tests {
+		client := new(V2ClientSession)
+		client.SetUserInfo(test.user, test.password, "Domain", "COMPUTER")
+		server := new(V2ServerSession)
+		server.SetCredentialProvider(CredentialProviderFunc(testCredentials))
+
+		_, err := runV2Handshake(t, client, server, false)
+		switch {
+		case test.err != nil && err != test.err:
+			t.Errorf("User %s: expected error %v got %v", test.user, test.err, err)
+		case test.err == nil && test.password == "Password" && err != nil:
+			t.Errorf("User %s could not authenticate: %s", test.user, err)
+		case test.err == nil && test.password != "Password" && err == nil:
+			t.Errorf("User %s authenticated with the wrong password", test.user)
+		}
+	}
+}
+
+func TestNTLMv1CredentialProvider(t *testing.T) {
+	for _, ess := range []bool{false, true} {
+		server := new(V1ServerSession)
+		server.SetCredentialProvider(CredentialProviderFunc(testCredentials))
+		server.SetExtendedSessionSecurity(ess)
+		challenge, _ := server.GenerateChallengeMessage()
+
+		client := new(V1ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "")
+		err := client.ProcessChallengeMessage(challenge)
+		if err != nil {
+			t.Fatalf("Could not process challenge message: %s", err)
+		}
+		am, _ := client.GenerateAuthenticateMessage()
+		am, err = ParseAuthenticateMessage(am.Bytes(), 1)
+		if err != nil {
+			t.Fatalf("Could not parse authenticate message: %s", err)
+		}
+
+		err = server.ProcessAuthenticateMessage(am)
+		if err != nil {
+			t.Errorf("Could not authenticate with ESS %v: %s", ess, err)
+		}
+		checkV1Value(t, "client seal key", server.ClientSealingKey, hex.EncodeToString(client.ClientSealingKey), nil)
+	}
+}
+
+func TestNTLMv1ClientHash(t *testing.T) {
+	lmHash, _ := LMHash("Password")
+	checkV1Value(t, "LMHash", lmHash, "e52cac67419a9a224a3b108f3fa6cb6d", nil)
+
+	for _, ess := range []bool{false, true} {
+		for _, withLmHash := range []bool{false, true} {
+			server := new(V1ServerSession)
+			server.SetUserInfo("User", "Password", "Domain", "")
+			server.SetExtendedSessionSecurity(ess)
+			challenge, _ := server.GenerateChallengeMessage()
+
+			client := new(V1ClientSession)
+			if withLmHash {
+				client.SetUserHash("User", NTHash("Password"), lmHash, "Domain", "")
+			} else {
+				client.SetUserHash("User", NTHash("Password"), nil, "Domain", "")
+			}
+			err := client.ProcessChallengeMessage(challenge)
+			if err != nil {
+				t.Fatalf("Could not process challenge message: %s", err)
+			}
+
+			if !ess {
+				if withLmHash {
+					expected, _ := desL(lmHash, server.serverChallenge)
+					checkV1Value(t, "LM response", client.lmChallengeResponse, hex.EncodeToString(expected), nil)
+				} else {
+					checkV1Value(t, "LM response", client.lmChallengeResponse, hex.EncodeToString(client.ntChallengeResponse), nil)
+				}
+			}
+
+			am, _ := client.GenerateAuthenticateMessage()
+			am, err = ParseAuthenticateMessage(am.Bytes(), 1)
+			if err != nil {
+				t.Fatalf("Could not parse authenticate message: %s", err)
+			}
+			err = server.ProcessAuthenticateMessage(am)
+			if err != nil {
+				t.Errorf("Could not authenticate with ESS %v and LM hash %v: %s", ess, withLmHash, err)
+			}
+			checkV1Value(t, "client seal key", server.ClientSealingKey, hex.EncodeToString(client.ClientSealingKey), nil)
+		}
+	}
+}
+
+func TestNTLMv2ClientHash(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserHash("User", NTHash("Password"), nil, "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	_, err := runV2Handshake(t, client, server, false)
+	if err != nil {
+		t.Fatalf("Could not authenticate with the NT hash: %s", err)
+	}
+	checkV2Value(t, "client seal key", server.ClientSealingKey, hex.EncodeToString(client.ClientSealingKey), nil)
+}
+
+func TestSetUserHashLength(t *testing.T) {
+	lmHash, _ := LMHash("Password")
+	for _, client := range []interface {
+		ClientSession
+		GetUserInfo() (string, string, string, string)
+	}{new(V1ClientSession), new(V2ClientSession)} {
+		if err := client.SetUserHash("User", NTHash("Password"), lmHash, "Domain", ""); err != nil {
+			t.Errorf("16 byte hashes should be accepted: %s", err)
+		}
+		if err := client.SetUserHash("User", NTHash("Password"), nil, "Domain", ""); err != nil {
+			t.Errorf("LM hash should be optional: %s", err)
+		}
+		if err := client.SetUserHash("Other", NTHash("Password")[:8], nil, "Domain", ""); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Short NT hash should be refused got %v", err)
+		}
+		if err := client.SetUserHash("Other", nil, lmHash, "Domain", ""); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Missing NT hash should be refused got %v", err)
+		}
+		if err := client.SetUserHash("Other", NTHash("Password"), append(lmHash, 0), "Domain", ""); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Long LM hash should be refused got %v", err)
+		}
+		if user, _, _, _ := client.GetUserInfo(); user != "User" {
+			t.Errorf("Refused hashes should not change the session got user %s", user)
+		}
+	}
+}
@@ -39,6 +39,11 @@ func nonce(length int) []byte {
 	return result
 }
 
+// Compares two MACs in constant time
+func hmacEqual(mac1 []byte, mac2 []byte) bool {
+	return hmacP.Equal(mac1, mac2)
+}
+
 func crc32(bytes []byte) uint32 {
 	crc := crc32P.New(crc32P.IEEETable)
 	crc.Write(bytes)
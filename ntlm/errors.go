@@ -0,0 +1,107 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NTStatus is the NTSTATUS code that Windows reports for the outcome of an authentication, front ends can use it
+// to pick the response they send to the client
+type NTStatus uint32
+
+const (
+	STATUS_SUCCESS                NTStatus = 0x00000000
+	STATUS_UNSUCCESSFUL           NTStatus = 0xC0000001
+	STATUS_INVALID_PARAMETER      NTStatus = 0xC000000D
+	STATUS_ACCESS_DENIED          NTStatus = 0xC0000022
+	STATUS_NO_SUCH_USER           NTStatus = 0xC0000064
+	STATUS_LOGON_FAILURE          NTStatus = 0xC000006D
+	STATUS_ACCOUNT_DISABLED       NTStatus = 0xC0000072
+	STATUS_INSUFFICIENT_RESOURCES NTStatus = 0xC000009A
+	STATUS_NOT_SUPPORTED          NTStatus = 0xC00000BB
+	STATUS_TIME_DIFFERENCE_AT_DC  NTStatus = 0xC0000133
+	STATUS_BAD_BINDINGS           NTStatus = 0xC000035B
+	STATUS_NTLM_BLOCKED           NTStatus = 0xC0000418
+)
+
+var statusNames = map[NTStatus]string{
+	STATUS_SUCCESS:                "STATUS_SUCCESS",
+	STATUS_UNSUCCESSFUL:           "STATUS_UNSUCCESSFUL",
+	STATUS_INVALID_PARAMETER:      "STATUS_INVALID_PARAMETER",
+	STATUS_ACCESS_DENIED:          "STATUS_ACCESS_DENIED",
+	STATUS_NO_SUCH_USER:           "STATUS_NO_SUCH_USER",
+	STATUS_LOGON_FAILURE:          "STATUS_LOGON_FAILURE",
+	STATUS_ACCOUNT_DISABLED:       "STATUS_ACCOUNT_DISABLED",
+	STATUS_INSUFFICIENT_RESOURCES: "STATUS_INSUFFICIENT_RESOURCES",
+	STATUS_NOT_SUPPORTED:          "STATUS_NOT_SUPPORTED",
+	STATUS_TIME_DIFFERENCE_AT_DC:  "STATUS_TIME_DIFFERENCE_AT_DC",
+	STATUS_BAD_BINDINGS:           "STATUS_BAD_BINDINGS",
+	STATUS_NTLM_BLOCKED:           "STATUS_NTLM_BLOCKED",
+}
+
+func (s NTStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08X", uint32(s))
+}
+
+// Error is the type of the errors that have an NTSTATUS code. The exported Err values are the kinds of failure, the
+// errors that are returned are either one of them or a more specific Error that unwraps to one of them, so callers
+// can check them with errors.Is and get the status with errors.As.
+type Error struct {
+	Status  NTStatus
+	Message string
+	// The kind of failure this error is a more specific case of
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Creates a more specific error of the same kind as parent
+func newError(parent *Error, message string) *Error {
+	return &Error{Status: parent.Status, Message: message, Err: parent}
+}
+
+var (
+	// ErrInvalidParameter is returned when the library is used with arguments that don't fit the session
+	ErrInvalidParameter = &Error{Status: STATUS_INVALID_PARAMETER, Message: "Invalid parameter"}
+	// ErrMalformedMessage is returned for messages that can not be parsed or that are missing required parts
+	ErrMalformedMessage = &Error{Status: STATUS_INVALID_PARAMETER, Message: "Malformed NTLM message"}
+	// ErrWrongMessageType is returned when a message has a different message type than the one that was expected
+	ErrWrongMessageType = &Error{Status: STATUS_INVALID_PARAMETER, Message: "Wrong NTLM message type", Err: ErrMalformedMessage}
+	// ErrLogonFailure is returned when the challenge responses do not match the credentials of the user
+	ErrLogonFailure = &Error{Status: STATUS_LOGON_FAILURE, Message: "Could not authenticate"}
+	// ErrMicMismatch is returned when the MIC of an AUTHENTICATE_MESSAGE is missing or not valid
+	ErrMicMismatch = &Error{Status: STATUS_LOGON_FAILURE, Message: "Authenticate message MIC is not valid", Err: ErrLogonFailure}
+	// ErrChannelBindingMismatch is returned when the channel bindings of the client are missing or do not match
+	ErrChannelBindingMismatch = &Error{Status: STATUS_BAD_BINDINGS, Message: "Authenticate message channel bindings do not match", Err: ErrLogonFailure}
+	// ErrPolicyViolation is returned when the server is configured to refuse the kind of authentication the client used
+	ErrPolicyViolation = &Error{Status: STATUS_NTLM_BLOCKED, Message: "NTLM authentication is not allowed by the server policy"}
+	// ErrNegotiationFailure is returned when the client and server have no options in common, or when the negotiated
+	// options need something the session does not have
+	ErrNegotiationFailure = &Error{Status: STATUS_NOT_SUPPORTED, Message: "Client and server could not negotiate the NTLM options"}
+	// ErrMessageAltered is returned when a signed or sealed message fails its signature check
+	ErrMessageAltered = &Error{Status: STATUS_ACCESS_DENIED, Message: "Message signature is not valid"}
+)
+
+// ErrorStatus returns the NTSTATUS code for the outcome of an authentication: STATUS_SUCCESS for nil, the status of
+// the Error in the chain of err, or STATUS_UNSUCCESSFUL for other errors
+func ErrorStatus(err error) NTStatus {
+	if err == nil {
+		return STATUS_SUCCESS
+	}
+	var ntlmErr *Error
+	if errors.As(err, &ntlmErr) {
+		return ntlmErr.Status
+	}
+	return STATUS_UNSUCCESSFUL
+}
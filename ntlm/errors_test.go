@@ -0,0 +1,140 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		user     string
+		password string
+		kind     error
+		status   NTStatus
+	}{
+		{"User", "Password", nil, STATUS_SUCCESS},
+		{"User", "Wrong", ErrLogonFailure, STATUS_LOGON_FAILURE},
+		{"Disabled", "Password", ErrAccountDisabled, STATUS_ACCOUNT_DISABLED},
+		{"Unknown", "Password", ErrUserNotFound, STATUS_NO_SUCH_USER},
+	}
+
+	for _, test := range tests {
+		client := new(V2ClientSession)
+		client.SetUserInfo(test.user, test.password, "Domain", "COMPUTER")
+		server := new(V2ServerSession)
+		server.SetCredentialProvider(CredentialProviderFunc(testCredentials))
+
+		_, err := runV2Handshake(t, client, server, false)
+		if !errors.Is(err, test.kind) {
+			t.Errorf("User %s: expected error %v got %v", test.user, test.kind, err)
+		}
+		if test.kind != nil && !errors.Is(err, ErrLogonFailure) {
+			t.Errorf("User %s: %v should be a logon failure", test.user, err)
+		}
+		if status := ErrorStatus(err); status != test.status {
+			t.Errorf("User %s: expected status %s got %s", test.user, test.status, status)
+		}
+	}
+
+	if ErrorStatus(errors.New("Some error")) != STATUS_UNSUCCESSFUL {
+		t.Error("Errors without a status should be STATUS_UNSUCCESSFUL")
+	}
+}
+
+func TestMalformedMessageErrors(t *testing.T) {
+	_, err := ParseAuthenticateMessage([]byte("NTLMSSP\x00\x03\x00\x00\x00"), 2)
+	if !errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrWrongMessageType) {
+		t.Errorf("Expected a malformed message error got %v", err)
+	}
+
+	_, err = ParseNegotiateMessage([]byte("NTLMSSP\x00\x02\x00\x00\x00\x07\x82\x00\x00"))
+	if !errors.Is(err, ErrWrongMessageType) || !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected a wrong message type error got %v", err)
+	}
+
+	var ntlmErr *Error
+	if !errors.As(err, &ntlmErr) || ntlmErr.Status != STATUS_INVALID_PARAMETER {
+		t.Errorf("Expected STATUS_INVALID_PARAMETER got %v", err)
+	}
+}
+
+func TestPolicyViolationErrors(t *testing.T) {
+	for _, err := range []error{ErrAnonymousNotAllowed, ErrResponseTypeNotAllowed} {
+		if !errors.Is(err, ErrPolicyViolation) || ErrorStatus(err) != STATUS_NTLM_BLOCKED {
+			t.Errorf("%v should be a policy violation", err)
+		}
+	}
+	if ErrorStatus(ErrChannelBindingMismatch) != STATUS_BAD_BINDINGS || ErrorStatus(ErrStaleResponse) != STATUS_TIME_DIFFERENCE_AT_DC {
+		t.Error("Channel binding and timestamp errors have the wrong status")
+	}
+	for _, err := range []error{ErrSignatureVersion, ErrSignatureChecksum, ErrSignatureSequence} {
+		if !errors.Is(err, ErrMessageAltered) || ErrorStatus(err) != STATUS_ACCESS_DENIED {
+			t.Errorf("%v should be a message altered error", err)
+		}
+	}
+	if STATUS_LOGON_FAILURE.String() != "STATUS_LOGON_FAILURE" || NTStatus(0xC0001234).String() != "0xC0001234" {
+		t.Error("NTStatus names are not correct")
+	}
+}
+
+func TestNegotiationFailureErrors(t *testing.T) {
+	_, err := NegotiateChallengeFlags(NTLM_NEGOTIATE_OEM.Set(0), NTLMSSP_NEGOTIATE_UNICODE.Set(0))
+	if !errors.Is(err, ErrNegotiationFailure) || ErrorStatus(err) != STATUS_NOT_SUPPORTED {
+		t.Errorf("Expected a negotiation failure got %v", err)
+	}
+
+	// NTLMSSP_NEGOTIATE_LM_KEY needs the LM hash, which a CredentialProvider does not return
+	server := new(V1ServerSession)
+	server.SetCredentialProvider(CredentialProviderFunc(testCredentials))
+	server.SetServerChallenge([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	server.NegotiateFlags = NTLMSSP_NEGOTIATE_LM_KEY.Set(0)
+	server.user = "User"
+	err = server.lookupCredentials()
+	if err != nil {
+		t.Fatalf("Could not look up credentials: %s", err)
+	}
+	err = server.computeKeyExchangeKey()
+	if !errors.Is(err, ErrNegotiationFailure) {
+		t.Errorf("Expected a negotiation failure without the LM hash got %v", err)
+	}
+}
+
+func TestCredentialProviderHashLength(t *testing.T) {
+	server := new(V2ServerSession)
+	server.SetCredentialProvider(CredentialProviderFunc(func(user, domain string) ([]byte, error) {
+		return NTHash("Password")[:8], nil
+	}))
+	err := server.lookupCredentials()
+	if !errors.Is(err, ErrInvalidHash) || ErrorStatus(err) != STATUS_INVALID_PARAMETER {
+		t.Errorf("Expected an invalid hash error got %v", err)
+	}
+}
+
+func TestSessionUsageErrors(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+
+	_, _, sealErr := client.Seal([]byte("Message"))
+	verifyErr := client.VerifySignature([]byte("Message"), make([]byte, 16))
+	_, _, datagramErr := client.SealDatagram([]byte("Message"), 0)
+	_, versionErr := CreateClientSession(Version(7), ConnectionOrientedMode)
+
+	tests := []struct {
+		err    error
+		kind   error
+		status NTStatus
+	}{
+		{sealErr, ErrNegotiationFailure, STATUS_NOT_SUPPORTED},
+		{verifyErr, ErrNegotiationFailure, STATUS_NOT_SUPPORTED},
+		{datagramErr, ErrInvalidParameter, STATUS_INVALID_PARAMETER},
+		{versionErr, ErrInvalidParameter, STATUS_INVALID_PARAMETER},
+	}
+	for _, test := range tests {
+		var ntlmErr *Error
+		if !errors.As(test.err, &ntlmErr) || ntlmErr.Status != test.status || !errors.Is(test.err, test.kind) {
+			t.Errorf("Expected %v with status %s got %v", test.kind, test.status, test.err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The server challenge used for the seed handshakes and the fuzzed server sessions, keeping it fixed lets the
+// fuzzer find its way into the response checks
+var fuzzServerChallenge = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+// Returns the negotiate, challenge and authenticate messages of a handshake, these are the seeds of the corpus
+func fuzzHandshake(f *testing.F, version Version) (nm, cm, am []byte) {
+	client, err := CreateClientSession(version, ConnectionOrientedMode)
+	if err != nil {
+		f.Fatal(err)
+	}
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := fuzzServerSession(version)
+
+	negotiate, err := client.GenerateNegotiateMessage()
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err = server.ProcessNegotiateMessage(negotiate); err != nil {
+		f.Fatal(err)
+	}
+	challenge, err := server.GenerateChallengeMessage()
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err = client.ProcessChallengeMessage(challenge); err != nil {
+		f.Fatal(err)
+	}
+	authenticate, err := client.GenerateAuthenticateMessage()
+	if err != nil {
+		f.Fatal(err)
+	}
+	return negotiate.Bytes(), challenge.Bytes(), authenticate.Bytes()
+}
+
+func fuzzServerSession(version Version) ServerSession {
+	server, _ := CreateServerSession(version, ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerChallenge(fuzzServerChallenge)
+	return server
+}
+
+func addHandshakeSeeds(f *testing.F, message int) {
+	for _, version := range []Version{Version1, Version2} {
+		nm, cm, am := fuzzHandshake(f, version)
+		f.Add([][]byte{nm, cm, am}[message])
+	}
+}
+
+func FuzzParseNegotiateMessage(f *testing.F) {
+	addHandshakeSeeds(f, 0)
+	f.Add([]byte("NTLMSSP\x00\x01\x00\x00\x00\x07\x82\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		nm, err := ParseNegotiateMessage(data)
+		if err != nil {
+			return
+		}
+		_ = nm.String()
+		if !bytes.Equal(nm.Bytes(), data) {
+			t.Error("Parsed negotiate message is not serialized as it was received")
+		}
+	})
+}
+
+func FuzzParseChallengeMessage(f *testing.F) {
+	addHandshakeSeeds(f, 1)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cm, err := ParseChallengeMessage(data)
+		if err != nil {
+			return
+		}
+		_ = cm.String()
+		if !bytes.Equal(cm.Bytes(), data) {
+			t.Error("Parsed challenge message is not serialized as it was received")
+		}
+
+		client := new(V2ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		if client.ProcessChallengeMessage(cm) == nil {
+			_, _ = client.GenerateAuthenticateMessage()
+		}
+	})
+}
+
+func FuzzParseAuthenticateMessage(f *testing.F) {
+	addHandshakeSeeds(f, 2)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, version := range []Version{VersionAuto, Version1, Version2} {
+			am, err := ParseAuthenticateMessage(data, int(version))
+			if err != nil {
+				continue
+			}
+			_ = am.String()
+			if !bytes.Equal(am.Bytes(), data) {
+				t.Error("Parsed authenticate message is not serialized as it was received")
+			}
+			_, _ = am.ResponseType()
+		}
+	})
+}
+
+func FuzzServerProcessAuthenticateMessage(f *testing.F) {
+	addHandshakeSeeds(f, 2)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, version := range []Version{VersionAuto, Version1, Version2} {
+			am, err := ParseAuthenticateMessage(data, int(version))
+			if err != nil {
+				continue
+			}
+			server := fuzzServerSession(version)
+			if _, err = server.GenerateChallengeMessage(); err != nil {
+				t.Fatal(err)
+			}
+			_ = server.ProcessAuthenticateMessage(am)
+		}
+	})
+}
+
+func FuzzReadAvPairs(f *testing.F) {
+	f.Add(defaultServerConfig().targetInfo().Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pairs, err := ReadAvPairs(data)
+		if err != nil {
+			return
+		}
+		_ = pairs.String()
+		_ = pairs.Bytes()
+	})
+}
+
+func FuzzReadNtlmV1Response(f *testing.F) {
+	f.Add(make([]byte, 24))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if r, err := ReadNtlmV1Response(data); err == nil {
+			_ = r.String()
+		}
+	})
+}
+
+func FuzzReadNtlmV2Response(f *testing.F) {
+	_, _, am := fuzzHandshake(f, Version2)
+	parsed, err := ParseAuthenticateMessage(am, 2)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(parsed.NtChallengeResponseFields.Payload)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if r, err := ReadNtlmV2Response(data); err == nil {
+			_ = r.String()
+		}
+	})
+}
+
+func FuzzReadLmResponse(f *testing.F) {
+	f.Add(make([]byte, 24))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if r, err := ReadLmV1Response(data); err == nil {
+			_ = r.String()
+		}
+		if r, err := ReadLmV2Response(data); err == nil {
+			_ = r.String()
+		}
+	})
+}
+
+func FuzzReadVersionStruct(f *testing.F) {
+	f.Add(defaultServerConfig().Version.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if v, err := ReadVersionStruct(data); err == nil {
+			_ = v.String()
+		}
+	})
+}
+
+func FuzzReadPayloadStruct(f *testing.F) {
+	f.Add([]byte{0x04, 0x00, 0x04, 0x00, 0x08, 0x00, 0x00, 0x00, 'U', 0x00, 's', 0x00}, 0)
+	f.Fuzz(func(t *testing.T, data []byte, startByte int) {
+		if p, err := ReadStringPayload(startByte, data); err == nil {
+			_ = p.String()
+		}
+	})
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for message := 0; message < 3; message++ {
+		addHandshakeSeeds(f, message)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := ParseMessage(data)
+		if err != nil {
+			return
+		}
+		_ = message.String()
+		if message.Type() != MessageType(data[8]) || !bytes.Equal(message.Bytes(), data) {
+			t.Errorf("Parsed %s is not serialized as it was received", message.Type())
+		}
+	})
+}
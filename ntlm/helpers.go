@@ -14,6 +14,45 @@ func concat(ar ...[]byte) []byte {
 	return bytes.Join(ar, nil)
 }
 
+// Serializes the values of the fields of a message without the payload offsets, which depend on the layout. A parsed
+// message whose fields still have the values they were parsed with is serialized as the bytes it was parsed from.
+func fieldValues(values ...interface{}) []byte {
+	var buffer bytes.Buffer
+	for _, value := range values {
+		switch v := value.(type) {
+		case uint32:
+			binary.Write(&buffer, binary.LittleEndian, v)
+		case []byte:
+			binary.Write(&buffer, binary.LittleEndian, uint32(len(v)))
+			buffer.Write(v)
+		case *PayloadStruct:
+			if v == nil {
+				buffer.WriteByte(0)
+				continue
+			}
+			buffer.WriteByte(1)
+			binary.Write(&buffer, binary.LittleEndian, v.Len)
+			binary.Write(&buffer, binary.LittleEndian, v.MaxLen)
+			buffer.Write(v.Payload)
+		case *VersionStruct:
+			if v == nil {
+				buffer.WriteByte(0)
+				continue
+			}
+			buffer.WriteByte(1)
+			buffer.Write(v.Bytes())
+		case *AvPairs:
+			if v == nil {
+				buffer.WriteByte(0)
+				continue
+			}
+			buffer.WriteByte(1)
+			buffer.Write(v.Bytes())
+		}
+	}
+	return buffer.Bytes()
+}
+
 // Create a 0 initialized slice of bytes
 func zeroBytes(length int) []byte {
 	return make([]byte, length, length)
@@ -39,19 +78,14 @@ func zeroPaddedBytes(bytes []byte, offset int, size int) []byte {
 	return newSlice
 }
 
+// MacsEqual compares two signatures made without extended session security, in constant time and without their
+// random pad in bytes 4-7. With extended session security these bytes are part of the checksum and a signature that
+// only differs in them would be accepted. Slices that are not 16 bytes are not signatures and never equal.
+//
+// Deprecated: MacsEqual does not know whether extended session security was negotiated. Use VerifySignature,
+// VerifyDatagramSignature or VerifyMac of the session instead.
 func MacsEqual(slice1, slice2 []byte) bool {
-	if len(slice1) != len(slice2) {
-		return false
-	}
-	for i := 0; i < len(slice1); i++ {
-		// bytes between 4 and 7 (inclusive) contains random
-		// data that should be ignored while comparing the
-		// macs
-		if (i < 4 || i > 7) && slice1[i] != slice2[i] {
-			return false
-		}
-	}
-	return true
+	return signaturesEqual(0, slice1, slice2)
 }
 
 func utf16FromString(s string) []byte {
@@ -60,7 +94,7 @@ func utf16FromString(s string) []byte {
 	result := zeroBytes(len(encoded) * 2)
 	for i := 0; i < len(encoded); i++ {
 		result[i*2] = byte(encoded[i])
-		result[i*2+1] = byte(encoded[i] << 8)
+		result[i*2+1] = byte(encoded[i] >> 8)
 	}
 	return result
 }
@@ -70,7 +104,7 @@ func utf16ToString(bytes []byte) string {
 	var data []uint16
 
 	// NOTE: This is definitely not the best way to do this, but when I tried using a buffer.Read I could not get it to work
-	for offset := 0; offset < len(bytes); offset = offset + 2 {
+	for offset := 0; offset+1 < len(bytes); offset = offset + 2 {
 		i := binary.LittleEndian.Uint16(bytes[offset : offset+2])
 		data = append(data, i)
 	}
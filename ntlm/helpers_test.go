@@ -16,6 +16,37 @@ func TestUTf16ToString(t *testing.T) {
 	}
 }
 
+func TestUTF16NonLatin1(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Пользователь": "1f043e043b044c0437043e0432043004420435043b044c04",
+		"用户":           "28753762",
+		"\U0001D11E":   "34d81edd",
+	} {
+		result := utf16FromString(name)
+		if hex.EncodeToString(result) != expected {
+			t.Errorf("utf16FromString(%q) got %s expected %s", name, hex.EncodeToString(result), expected)
+		}
+		if utf16ToString(result) != name {
+			t.Errorf("utf16ToString got %q expected %q", utf16ToString(result), name)
+		}
+	}
+}
+
+func TestNTLMv2NonLatin1User(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("Пользователь", "Пароль", "Домен", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("Пользователь", "Пароль", "Домен", "")
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate a user with a non Latin-1 name: %s", err)
+	}
+	if am.UserName.String() != "Пользователь" || am.DomainName.String() != "Домен" {
+		t.Errorf("Names were not encoded correctly got %q and %q", am.UserName.String(), am.DomainName.String())
+	}
+}
+
 func TestMacsEquals(t *testing.T) {
 	// the MacsEqual should ignore the values in the second 4 bytes
 	firstSlice := []byte{0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9, 0xf0, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff}
@@ -0,0 +1,92 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Logger receives the log messages of a session. The keysAndValues are alternating keys and values, like the
+// attributes of log/slog, so a Logger can easily be implemented on top of a structured logging library.
+type Logger interface {
+	Log(level LogLevel, message string, keysAndValues ...interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface
+type LoggerFunc func(level LogLevel, message string, keysAndValues ...interface{})
+
+func (f LoggerFunc) Log(level LogLevel, message string, keysAndValues ...interface{}) {
+	f(level, message, keysAndValues...)
+}
+
+// NewStdLogger returns a Logger that writes the messages of at least minLevel to a log.Logger as
+// "LEVEL message key=value ..."
+func NewStdLogger(logger *log.Logger, minLevel LogLevel) Logger {
+	return LoggerFunc(func(level LogLevel, message string, keysAndValues ...interface{}) {
+		if level < minLevel {
+			return
+		}
+
+		var buffer bytes.Buffer
+		buffer.WriteString(level.String())
+		buffer.WriteString(" ")
+		buffer.WriteString(message)
+		for i := 0; i+1 < len(keysAndValues); i = i + 2 {
+			buffer.WriteString(fmt.Sprintf(" %v=%v", keysAndValues[i], keysAndValues[i+1]))
+		}
+		logger.Print(buffer.String())
+	})
+}
+
+// The value that is logged instead of user, domain and workstation names unless SetLogIdentities is used
+const redactedValue = "[REDACTED]"
+
+// SetLogger sets the Logger the session writes its messages to. Without a Logger the session does not log anything.
+func (n *SessionData) SetLogger(logger Logger) {
+	n.logger = logger
+}
+
+// SetLogIdentities makes the session log the user, domain and workstation names of the client. By default they are
+// replaced with [REDACTED] so that the log does not contain the identities of the users.
+func (n *SessionData) SetLogIdentities(logIdentities bool) {
+	n.logIdentities = logIdentities
+}
+
+func (n *SessionData) log(level LogLevel, message string, keysAndValues ...interface{}) {
+	if n.logger != nil {
+		n.logger.Log(level, message, keysAndValues...)
+	}
+}
+
+// Returns the identity value to log, which is redacted unless SetLogIdentities was used
+func (n *SessionData) identity(value string) string {
+	if n.logIdentities || value == "" {
+		return value
+	}
+	return redactedValue
+}
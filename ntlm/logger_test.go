@@ -0,0 +1,51 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRedaction(t *testing.T) {
+	for _, logIdentities := range []bool{false, true} {
+		var output bytes.Buffer
+		client := new(V2ClientSession)
+		client.SetUserInfo("SecretUser", "Password", "SecretDomain", "COMPUTER")
+		server := new(V2ServerSession)
+		server.SetUserInfo("SecretUser", "Password", "SecretDomain", "")
+		server.SetLogger(NewStdLogger(log.New(&output, "", 0), LogDebug))
+		server.SetLogIdentities(logIdentities)
+
+		if _, err := runV2Handshake(t, client, server, false); err != nil {
+			t.Fatalf("Could not authenticate: %s", err)
+		}
+
+		logged := output.String()
+		if !strings.Contains(logged, "INFO Processing NTLM v2 authenticate message") {
+			t.Errorf("Expected the authenticate message to be logged got %q", logged)
+		}
+		if strings.Contains(logged, "SecretUser") != logIdentities || strings.Contains(logged, "SecretDomain") != logIdentities {
+			t.Errorf("Identities should be logged: %t got %q", logIdentities, logged)
+		}
+		if !logIdentities && !strings.Contains(logged, "user=[REDACTED]") {
+			t.Errorf("Expected the user to be redacted got %q", logged)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewStdLogger(log.New(&output, "", 0), LogWarn)
+	logger.Log(LogInfo, "not logged")
+	logger.Log(LogError, "logged", "key", 1)
+	if output.String() != "ERROR logged key=1\n" {
+		t.Errorf("Expected only the error to be logged got %q", output.String())
+	}
+
+	// Sessions without a logger do not log anything
+	session := new(SessionData)
+	session.log(LogError, "not logged")
+}
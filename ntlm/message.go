@@ -0,0 +1,103 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// MessageType is the type of an NTLM message as found after the NTLMSSP signature
+type MessageType uint32
+
+const (
+	NegotiateMessageType    MessageType = 1
+	ChallengeMessageType    MessageType = 2
+	AuthenticateMessageType MessageType = 3
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case NegotiateMessageType:
+		return "NEGOTIATE_MESSAGE"
+	case ChallengeMessageType:
+		return "CHALLENGE_MESSAGE"
+	case AuthenticateMessageType:
+		return "AUTHENTICATE_MESSAGE"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint32(t))
+}
+
+// Message is implemented by the NEGOTIATE_MESSAGE, CHALLENGE_MESSAGE and AUTHENTICATE_MESSAGE so that tokens can be
+// handled without knowing which message they contain
+type Message interface {
+	Type() MessageType
+	Bytes() []byte
+	String() string
+	Flags() uint32
+}
+
+// ParseMessage parses a NEGOTIATE_MESSAGE, CHALLENGE_MESSAGE or AUTHENTICATE_MESSAGE depending on its message type.
+// The version of an AUTHENTICATE_MESSAGE is detected from its NT response like with VersionAuto.
+func ParseMessage(body []byte) (Message, error) {
+	if len(body) < 12 {
+		return nil, newError(ErrMalformedMessage, "NTLM message is too short for the signature and message type")
+	}
+	if !bytes.Equal(body[0:8], []byte("NTLMSSP\x00")) {
+		return nil, newError(ErrMalformedMessage, "Invalid NTLM message signature")
+	}
+
+	var message Message
+	var err error
+
+	// The messages are only assigned without an error, a nil pointer in the interface would not be nil
+	switch MessageType(binary.LittleEndian.Uint32(body[8:12])) {
+	case NegotiateMessageType:
+		var nm *NegotiateMessage
+		if nm, err = ParseNegotiateMessage(body); err == nil {
+			message = nm
+		}
+	case ChallengeMessageType:
+		var cm *ChallengeMessage
+		if cm, err = ParseChallengeMessage(body); err == nil {
+			message = cm
+		}
+	case AuthenticateMessageType:
+		var am *AuthenticateMessage
+		if am, err = ParseAuthenticateMessage(body, int(VersionAuto)); err == nil {
+			message = am
+		}
+	default:
+		err = newError(ErrWrongMessageType, "Unknown NTLM message type")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (n *NegotiateMessage) Type() MessageType {
+	return NegotiateMessageType
+}
+
+func (n *NegotiateMessage) Flags() uint32 {
+	return n.NegotiateFlags
+}
+
+func (c *ChallengeMessage) Type() MessageType {
+	return ChallengeMessageType
+}
+
+func (c *ChallengeMessage) Flags() uint32 {
+	return c.NegotiateFlags
+}
+
+func (a *AuthenticateMessage) Type() MessageType {
+	return AuthenticateMessageType
+}
+
+func (a *AuthenticateMessage) Flags() uint32 {
+	return a.NegotiateFlags
+}
@@ -6,7 +6,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
@@ -51,32 +50,62 @@ type AuthenticateMessage struct {
 
 	// payload - variable
 	Payload []byte
+
+	// The bytes of a parsed message and the offset of the MIC within them, these are needed to verify the MIC
+	rawBytes  []byte
+	micOffset int
+	// The field values of a parsed message, when they are unchanged Bytes returns the rawBytes
+	parsedFields []byte
 }
 
 func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*AuthenticateMessage, error) {
+	// The fields up to and including the workstation fields are always present
+	if len(body) < 52 {
+		return nil, newError(ErrMalformedMessage, "invalid NTLM authenticate")
+	}
+
 	am := new(AuthenticateMessage)
 
 	am.Signature = body[0:8]
 	if !bytes.Equal(am.Signature, []byte("NTLMSSP\x00")) {
-		return nil, errors.New("Invalid NTLM message signature")
+		return nil, newError(ErrMalformedMessage, "Invalid NTLM message signature")
 	}
 
 	am.MessageType = binary.LittleEndian.Uint32(body[8:12])
 	if am.MessageType != 3 {
-		return nil, errors.New("Invalid NTLM message type should be 0x00000003 for authenticate message")
+		return nil, newError(ErrWrongMessageType, "Invalid NTLM message type should be 0x00000003 for authenticate message")
 	}
 
 	var err error
 
+	// With VersionAuto the version follows from the NT response, NTLMv1 responses are 24 bytes and NTLMv2
+	// responses are longer
+	if ntlmVersion == int(VersionAuto) {
+		ntResponse, err := ReadBytePayload(20, body)
+		if err != nil {
+			return nil, err
+		}
+		ntlmVersion = 1
+		if len(ntResponse.Payload) > 24 {
+			ntlmVersion = 2
+		}
+	}
+
 	am.LmChallengeResponse, err = ReadBytePayload(12, body)
 	if err != nil {
 		return nil, err
 	}
 
-	if ntlmVersion == 2 {
-		am.LmV2Response = ReadLmV2Response(am.LmChallengeResponse.Payload)
-	} else {
-		am.LmV1Response = ReadLmV1Response(am.LmChallengeResponse.Payload)
+	// The LM response of an anonymous client is a single zero byte
+	if len(am.LmChallengeResponse.Payload) >= 24 {
+		if ntlmVersion == 2 {
+			am.LmV2Response, err = ReadLmV2Response(am.LmChallengeResponse.Payload)
+		} else {
+			am.LmV1Response, err = ReadLmV1Response(am.LmChallengeResponse.Payload)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	am.NtChallengeResponseFields, err = ReadBytePayload(20, body)
@@ -84,11 +113,13 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*AuthenticateMessag
 		return nil, err
 	}
 
-	// Check to see if this is a v1 or v2 response
-	if ntlmVersion == 2 {
-		am.NtlmV2Response, err = ReadNtlmV2Response(am.NtChallengeResponseFields.Payload)
-	} else {
-		am.NtlmV1Response, err = ReadNtlmV1Response(am.NtChallengeResponseFields.Payload)
+	// Check to see if this is a v1 or v2 response, anonymous clients send no NT response at all
+	if len(am.NtChallengeResponseFields.Payload) > 0 {
+		if ntlmVersion == 2 {
+			am.NtlmV2Response, err = ReadNtlmV2Response(am.NtChallengeResponseFields.Payload)
+		} else {
+			am.NtlmV1Response, err = ReadNtlmV1Response(am.NtChallengeResponseFields.Payload)
+		}
 	}
 
 	if err != nil {
@@ -118,6 +149,10 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*AuthenticateMessag
 	// security buffer header, at offset 52. This form is seen in older Win9x-based systems. This is from the davenport notes about Type 3
 	// messages and this information does not seem to be present in the MS-NLMP document
 	if lowestOffset > 52 {
+		if len(body) < 64 {
+			return nil, newError(ErrMalformedMessage, "Authenticate message is too short for the session key and flags")
+		}
+
 		am.EncryptedRandomSessionKey, err = ReadBytePayload(offset, body)
 		if err != nil {
 			return nil, err
@@ -127,11 +162,27 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*AuthenticateMessag
 		am.NegotiateFlags = binary.LittleEndian.Uint32(body[offset : offset+4])
 		offset = offset + 4
 
+		// The names are in the OEM code page when the client did not negotiate unicode
+		if isOemOnly(am.NegotiateFlags) {
+			am.DomainName.Type = OemStringPayload
+			am.UserName.Type = OemStringPayload
+			am.Workstation.Type = OemStringPayload
+		}
+
 		// Version (8 bytes): A VERSION structure (section 2.2.2.10) that is present only when the NTLMSSP_NEGOTIATE_VERSION flag is set in the NegotiateFlags field. This structure is used for debugging purposes only. In normal protocol messages, it is ignored and does not affect the NTLM message processing.<9>
-		if NTLMSSP_NEGOTIATE_VERSION.IsSet(am.NegotiateFlags) {
-			am.Version, err = ReadVersionStruct(body[offset : offset+8])
-			if err != nil {
-				return nil, err
+		// The field is zero when the flag is not set. Clients that predate the VERSION structure leave it out, which can
+		// only be seen from where the payload starts: they have either no room after the flags or only room for a MIC.
+		var lowestOffset = am.getLowestPayloadOffset()
+		hasVersion := NTLMSSP_NEGOTIATE_VERSION.IsSet(am.NegotiateFlags)
+		if hasVersion || (len(body) >= offset+8 && lowestOffset >= offset+8 && lowestOffset != offset+16) {
+			if len(body) < offset+8 {
+				return nil, newError(ErrMalformedMessage, "Authenticate message is too short for the version")
+			}
+			if hasVersion {
+				am.Version, err = ReadVersionStruct(body[offset : offset+8])
+				if err != nil {
+					return nil, err
+				}
 			}
 			offset = offset + 8
 		}
@@ -142,15 +193,19 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*AuthenticateMessag
 		// However there is no TargetInfo structure in the Authenticate Message! There is one in the Challenge Message though. So I'm using
 		// a hack to check to see if there is a MIC. I look to see if there is room for the MIC before the payload starts. If so I assume
 		// there is a MIC and read it out.
-		var lowestOffset = am.getLowestPayloadOffset()
-		if lowestOffset > offset {
+		if lowestOffset >= offset+16 && len(body) >= offset+16 {
 			// MIC - 16 bytes
 			am.Mic = body[offset : offset+16]
+			am.micOffset = offset
 			offset = offset + 16
 		}
+	} else {
+		am.EncryptedRandomSessionKey, _ = CreateBytePayload(make([]byte, 0))
 	}
 
 	am.Payload = body[offset:]
+	am.rawBytes = body
+	am.parsedFields = am.fieldValues()
 
 	return am, nil
 }
@@ -158,13 +213,34 @@ func ParseAuthenticateMessage(body []byte, ntlmVersion int) (*AuthenticateMessag
 func (a *AuthenticateMessage) ClientChallenge() (response []byte) {
 	if a.NtlmV2Response != nil {
 		response = a.NtlmV2Response.NtlmV2ClientChallenge.ChallengeFromClient
-	} else if a.NtlmV1Response != nil && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(a.NegotiateFlags) {
+	} else if a.NtlmV1Response != nil && a.LmV1Response != nil && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(a.NegotiateFlags) {
 		response = a.LmV1Response.Response[0:8]
 	}
 
 	return response
 }
 
+// The anonymous form of the message has no user name, no NT response and an empty or Z(1) LM response
+func (a *AuthenticateMessage) isAnonymous() bool {
+	lm := a.LmChallengeResponse.Payload
+	return a.UserName.Len == 0 && a.NtChallengeResponseFields.Len == 0 && (len(lm) == 0 || bytes.Equal(lm, []byte{0}))
+}
+
+// Returns the message with the MIC field set to zero, which is the form the MIC is calculated over
+func (a *AuthenticateMessage) bytesWithoutMic() []byte {
+	if a.rawBytes != nil {
+		result := concat(a.rawBytes)
+		if a.Mic != nil {
+			copy(result[a.micOffset:a.micOffset+16], zeroBytes(16))
+		}
+		return result
+	}
+
+	withoutMic := *a
+	withoutMic.Mic = zeroBytes(16)
+	return withoutMic.Bytes()
+}
+
 func (a *AuthenticateMessage) getLowestPayloadOffset() int {
 	payloadStructs := [...]*PayloadStruct{a.LmChallengeResponse, a.NtChallengeResponseFields, a.DomainName, a.UserName, a.Workstation, a.EncryptedRandomSessionKey}
 
@@ -180,9 +256,26 @@ func (a *AuthenticateMessage) getLowestPayloadOffset() int {
 	return lowest
 }
 
+func (a *AuthenticateMessage) fieldValues() []byte {
+	return fieldValues(a.Signature, a.MessageType, a.LmChallengeResponse, a.NtChallengeResponseFields, a.DomainName, a.UserName,
+		a.Workstation, a.EncryptedRandomSessionKey, a.NegotiateFlags, a.Version, a.Mic)
+}
+
+// Bytes returns the bytes of a parsed message as they were received as long as its fields were not changed,
+// otherwise the message is laid out again
 func (a *AuthenticateMessage) Bytes() []byte {
+	if a.rawBytes != nil && bytes.Equal(a.fieldValues(), a.parsedFields) {
+		return concat(a.rawBytes)
+	}
+
+	// A parsed message only gets a MIC when it had one, messages that are created always have room for one
+	hasMic := a.Mic != nil || a.rawBytes == nil
+
 	payloadLen := int(a.LmChallengeResponse.Len + a.NtChallengeResponseFields.Len + a.DomainName.Len + a.UserName.Len + a.Workstation.Len + a.EncryptedRandomSessionKey.Len)
-	messageLen := 8 + 4 + 6*8 + 4 + 8 + 16
+	messageLen := 8 + 4 + 6*8 + 4 + 8
+	if hasMic {
+		messageLen = messageLen + 16
+	}
 	payloadOffset := uint32(messageLen)
 
 	messageBytes := make([]byte, 0, messageLen+payloadLen)
@@ -218,7 +311,8 @@ func (a *AuthenticateMessage) Bytes() []byte {
 
 	buffer.Write(uint32ToBytes(a.NegotiateFlags))
 
-	if a.Version != nil {
+	// The version field is always there, it is zero unless NTLMSSP_NEGOTIATE_VERSION is set, so the MIC is at offset 72
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(a.NegotiateFlags) && a.Version != nil {
 		buffer.Write(a.Version.Bytes())
 	} else {
 		buffer.Write(make([]byte, 8))
@@ -226,7 +320,7 @@ func (a *AuthenticateMessage) Bytes() []byte {
 
 	if a.Mic != nil {
 		buffer.Write(a.Mic)
-	} else {
+	} else if hasMic {
 		buffer.Write(make([]byte, 16))
 	}
 
@@ -5,6 +5,7 @@ package ntlm
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"testing"
 )
@@ -41,7 +42,7 @@ func TestAuthenticateNtlmV1(t *testing.T) {
 		t.Error("Could not parse authenticate message")
 	}
 
-	a.String()
+	_ = a.String()
 
 	outBytes := a.Bytes()
 
@@ -92,7 +93,7 @@ func TestAuthenticateNtlmV2(t *testing.T) {
 		t.Errorf("Length of payload is incorrect got: %d, should be %d", len(a.Payload), 356)
 	}
 
-	a.String()
+	_ = a.String()
 
 	// Generate the bytes from the message and reparse it and make sure that works
 	bytes := a.Bytes()
@@ -100,3 +101,106 @@ func TestAuthenticateNtlmV2(t *testing.T) {
 
 	}
 }
+
+func TestParseAuthenticateOutOfBounds(t *testing.T) {
+	if _, err := ParseAuthenticateMessage([]byte("NTLMSSP\x00\x03\x00\x00\x00"), 2); err == nil {
+		t.Error("Authenticate message without the payload fields should be an error")
+	}
+
+	authenticateData := make([]byte, 64)
+	copy(authenticateData, "NTLMSSP\x00\x03\x00\x00\x00")
+	// The NT response claims 0x100 bytes at offset 64, past the end of the message
+	copy(authenticateData[20:28], []byte{0x00, 0x01, 0x00, 0x01, 0x40, 0x00, 0x00, 0x00})
+	if _, err := ParseAuthenticateMessage(authenticateData, 2); err == nil {
+		t.Error("Payload that runs past the end of the message should be an error")
+	}
+
+	// Len larger than MaxLen
+	copy(authenticateData[20:28], []byte{0x10, 0x00, 0x08, 0x00, 0x30, 0x00, 0x00, 0x00})
+	if _, err := ParseAuthenticateMessage(authenticateData, 2); err == nil {
+		t.Error("Payload longer than its maximum length should be an error")
+	}
+}
+
+func TestAuthenticateRoundTrip(t *testing.T) {
+	// The payloads of this message are not in the order Bytes writes them
+	authenticateMessage := "TlRMTVNTUAADAAAAGAAYAIgAAAAYABgAoAAAAAAAAABYAAAAIAAgAFgAAAAQABAAeAAAABAAEAC4AAAAVYKQYgYBsR0AAAAP2BgW++b14Dh6Z5B4Xs1DiHAAYQB1AGwAQABwAGEAdQBsAGQAaQB4AC4AbgBlAHQAVwBJAE4ANwBfAEkARQA4ACugxZFzvHB4P6LdKbbZpiYHo2ErZURLiSugxZFzvHB4P6LdKbbZpiYHo2ErZURLibmpCUlnbq2I4LAdEhLdg7I="
+	authenticateData, _ := base64.StdEncoding.DecodeString(authenticateMessage)
+
+	a, err := ParseAuthenticateMessage(authenticateData, 1)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	if !bytes.Equal(a.Bytes(), authenticateData) {
+		t.Error("Unchanged message should be serialized as it was received")
+	}
+
+	a.UserName, _ = CreateStringPayload("other")
+	edited, err := ParseAuthenticateMessage(a.Bytes(), 1)
+	if err != nil {
+		t.Fatalf("Could not parse edited authenticate message: %s", err)
+	}
+	if edited.UserName.String() != "other" || edited.Workstation.String() != a.Workstation.String() || !bytes.Equal(edited.Mic, a.Mic) {
+		t.Errorf("Edited message is not correct: %s", edited)
+	}
+}
+
+func TestAuthenticateWin9xRoundTrip(t *testing.T) {
+	// The form without the session key, flags, version and MIC, the payload starts at offset 52
+	user := utf16FromString("User")
+	lmResponse := bytes.Repeat([]byte{0x11}, 24)
+	data := make([]byte, 52)
+	copy(data, "NTLMSSP\x00\x03\x00\x00\x00")
+	copy(data[12:20], []byte{24, 0, 24, 0, 52, 0, 0, 0})
+	copy(data[36:44], []byte{byte(len(user)), 0, byte(len(user)), 0, 76, 0, 0, 0})
+	data = append(append(data, lmResponse...), user...)
+
+	a, err := ParseAuthenticateMessage(data, 1)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	if !bytes.Equal(a.Bytes(), data) {
+		t.Errorf("Unchanged message should be serialized as it was received got %x", a.Bytes())
+	}
+
+	a.UserName, _ = CreateStringPayload("Other")
+	edited, err := ParseAuthenticateMessage(a.Bytes(), 1)
+	if err != nil {
+		t.Fatalf("Could not parse edited authenticate message: %s", err)
+	}
+	if edited.UserName.String() != "Other" || edited.Mic != nil || !bytes.Equal(edited.LmChallengeResponse.Payload, lmResponse) {
+		t.Errorf("Edited message is not correct: %s", edited)
+	}
+}
+
+func TestAuthenticateVersionField(t *testing.T) {
+	// Without NTLMSSP_NEGOTIATE_VERSION the version field is zero, older clients leave it out
+	tests := []struct {
+		payloadOffset int
+		micOffset     int
+	}{
+		{72, 0},
+		{80, 64},
+		{88, 72},
+	}
+
+	for _, test := range tests {
+		lmResponse := bytes.Repeat([]byte{0x11}, 24)
+		data := make([]byte, test.payloadOffset)
+		copy(data, "NTLMSSP\x00\x03\x00\x00\x00")
+		copy(data[12:20], []byte{24, 0, 24, 0, byte(test.payloadOffset), 0, 0, 0})
+		binary.LittleEndian.PutUint32(data[60:64], NTLMSSP_NEGOTIATE_UNICODE.Set(NTLMSSP_NEGOTIATE_NTLM.Set(0)))
+		data = append(data, lmResponse...)
+
+		a, err := ParseAuthenticateMessage(data, 1)
+		if err != nil {
+			t.Fatalf("Payload at %d: could not parse authenticate message: %s", test.payloadOffset, err)
+		}
+		if a.Version != nil || a.micOffset != test.micOffset || (a.Mic != nil) != (test.micOffset != 0) {
+			t.Errorf("Payload at %d: expected the MIC at %d got %d", test.payloadOffset, test.micOffset, a.micOffset)
+		}
+		if !bytes.Equal(a.LmChallengeResponse.Payload, lmResponse) {
+			t.Errorf("Payload at %d: LM response not correct", test.payloadOffset)
+		}
+	}
+}
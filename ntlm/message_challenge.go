@@ -6,7 +6,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 )
 
@@ -45,29 +44,38 @@ type ChallengeMessage struct {
 
 	// targetinfo  - 12 bytes
 	TargetInfoPayloadStruct *PayloadStruct
-	TargetInfo              *AvPairs
+	// The AV_PAIRs of the TargetInfoPayloadStruct. Bytes writes them in its place when the message was not parsed
+	// or when they were changed after parsing.
+	TargetInfo *AvPairs
 
 	// version - 8 bytes
 	Version *VersionStruct
 	// payload - variable
 	Payload []byte
+
+	// The bytes of a parsed message, these are needed to calculate the MIC
+	rawBytes []byte
+	// The field values of a parsed message, when they are unchanged Bytes returns the rawBytes
+	parsedFields []byte
+	// The AV_PAIRs of a parsed message, to tell whether the TargetInfo was changed
+	parsedTargetInfo []byte
 }
 
 func ParseChallengeMessage(body []byte) (*ChallengeMessage, error) {
 	if len(body) < 32 {
-		return nil, errors.New("invalid NTLM challenge")
+		return nil, newError(ErrMalformedMessage, "invalid NTLM challenge")
 	}
 
 	challenge := new(ChallengeMessage)
 
 	challenge.Signature = body[0:8]
 	if !bytes.Equal(challenge.Signature, []byte("NTLMSSP\x00")) {
-		return challenge, errors.New("Invalid NTLM message signature")
+		return challenge, newError(ErrMalformedMessage, "Invalid NTLM message signature")
 	}
 
 	challenge.MessageType = binary.LittleEndian.Uint32(body[8:12])
 	if challenge.MessageType != 2 {
-		return challenge, errors.New("Invalid NTLM message type should be 0x00000002 for challenge message")
+		return challenge, newError(ErrWrongMessageType, "Invalid NTLM message type should be 0x00000002 for challenge message")
 	}
 
 	var err error
@@ -78,13 +86,19 @@ func ParseChallengeMessage(body []byte) (*ChallengeMessage, error) {
 	}
 
 	challenge.NegotiateFlags = binary.LittleEndian.Uint32(body[20:24])
+	if isOemOnly(challenge.NegotiateFlags) {
+		challenge.TargetName.Type = OemStringPayload
+	}
 
 	challenge.ServerChallenge = body[24:32]
 	offset := 32
 
-	if NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(challenge.NegotiateFlags) {
+	// The Context and TargetInfo fields are required when there is target info, but they are also present
+	// in messages without target info as long as the payload does not start right after the server challenge
+	hasTargetInfo := NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(challenge.NegotiateFlags)
+	if hasTargetInfo || (len(body) >= 48 && challenge.getLowestPayloadOffset() >= 48) {
 		if len(body) < 48 {
-			return nil, errors.New("invalid NTLMSSP_NEGOTIATE_TARGET_INFO")
+			return nil, newError(ErrMalformedMessage, "invalid NTLMSSP_NEGOTIATE_TARGET_INFO")
 		}
 
 		challenge.Reserved = body[32:40]
@@ -94,25 +108,59 @@ func ParseChallengeMessage(body []byte) (*ChallengeMessage, error) {
 			return nil, err
 		}
 
-		challenge.TargetInfo = ReadAvPairs(challenge.TargetInfoPayloadStruct.Payload)
+		if hasTargetInfo {
+			challenge.TargetInfo, err = ReadAvPairs(challenge.TargetInfoPayloadStruct.Payload)
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		offset = 48
 
-		if NTLMSSP_NEGOTIATE_VERSION.IsSet(challenge.NegotiateFlags) {
-			challenge.Version, err = ReadVersionStruct(body[offset : offset+8])
-			if err != nil {
-				return nil, err
+		// Like in the negotiate message the version field is left out by systems that predate it, and it is zero
+		// when the flag is not set
+		if len(body) >= 56 && challenge.getLowestPayloadOffset() >= 56 {
+			if NTLMSSP_NEGOTIATE_VERSION.IsSet(challenge.NegotiateFlags) {
+				challenge.Version, err = ReadVersionStruct(body[offset : offset+8])
+				if err != nil {
+					return nil, err
+				}
 			}
 			offset = offset + 8
 		}
 	}
 
 	challenge.Payload = body[offset:]
+	challenge.rawBytes = body
+	challenge.parsedFields = challenge.fieldValues()
+	if challenge.TargetInfo != nil {
+		challenge.parsedTargetInfo = challenge.TargetInfo.Bytes()
+	}
 
 	return challenge, nil
 }
 
+func (c *ChallengeMessage) fieldValues() []byte {
+	return fieldValues(c.Signature, c.MessageType, c.TargetName, c.NegotiateFlags, c.ServerChallenge, c.Reserved,
+		c.TargetInfoPayloadStruct, c.TargetInfo, c.Version)
+}
+
+// Bytes returns the bytes of a parsed message as they were received as long as its fields were not changed,
+// otherwise the message is laid out again
 func (c *ChallengeMessage) Bytes() []byte {
+	if c.rawBytes != nil && bytes.Equal(c.fieldValues(), c.parsedFields) {
+		return concat(c.rawBytes)
+	}
+
+	if c.TargetInfo != nil {
+		if targetInfo := c.TargetInfo.Bytes(); c.TargetInfoPayloadStruct == nil || !bytes.Equal(targetInfo, c.parsedTargetInfo) {
+			c.TargetInfoPayloadStruct, _ = CreateBytePayload(targetInfo)
+		}
+	}
+	if c.TargetInfoPayloadStruct == nil {
+		c.TargetInfoPayloadStruct, _ = CreateBytePayload(make([]byte, 0))
+	}
+
 	payloadLen := int(c.TargetName.Len + c.TargetInfoPayloadStruct.Len)
 	messageLen := 8 + 4 + 8 + 4 + 8 + 8 + 8 + 8
 	payloadOffset := uint32(messageLen)
@@ -129,17 +177,22 @@ func (c *ChallengeMessage) Bytes() []byte {
 
 	binary.Write(buffer, binary.LittleEndian, c.NegotiateFlags)
 	buffer.Write(c.ServerChallenge)
-	buffer.Write(make([]byte, 8))
+	if len(c.Reserved) == 8 {
+		buffer.Write(c.Reserved)
+	} else {
+		buffer.Write(make([]byte, 8))
+	}
 
 	c.TargetInfoPayloadStruct.Offset = payloadOffset
 	buffer.Write(c.TargetInfoPayloadStruct.Bytes())
 	payloadOffset += uint32(c.TargetInfoPayloadStruct.Len)
 
-	// if(c.Version != nil) {
-	buffer.Write(c.Version.Bytes())
-	// } else {
-	//  buffer.Write(make([]byte, 8))
-	//}
+	// The version field is always there, it is zero unless NTLMSSP_NEGOTIATE_VERSION is set
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(c.NegotiateFlags) && c.Version != nil {
+		buffer.Write(c.Version.Bytes())
+	} else {
+		buffer.Write(make([]byte, 8))
+	}
 
 	// Write out the payloads
 	buffer.Write(c.TargetName.Payload)
@@ -148,6 +201,14 @@ func (c *ChallengeMessage) Bytes() []byte {
 	return buffer.Bytes()
 }
 
+// Returns the message as it was received, or the serialized message if it was not parsed
+func (c *ChallengeMessage) wireBytes() []byte {
+	if c.rawBytes != nil {
+		return c.rawBytes
+	}
+	return c.Bytes()
+}
+
 func (c *ChallengeMessage) getLowestPayloadOffset() int {
 	payloadStructs := [...]*PayloadStruct{c.TargetName, c.TargetInfoPayloadStruct}
 
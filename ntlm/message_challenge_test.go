@@ -5,6 +5,7 @@ package ntlm
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"testing"
@@ -46,7 +47,7 @@ func TestDecodeChallenge(t *testing.T) {
 		t.Error("Payload length is not long enough")
 	}
 
-	challenge.String()
+	_ = challenge.String()
 
 	outBytes := challenge.Bytes()
 
@@ -83,3 +84,88 @@ func TestParseChallengeInvalidNegotiateTargetInfo(t *testing.T) {
 		t.Error("expected error, got nil")
 	}
 }
+
+func TestParseChallengeTargetInfoOutOfBounds(t *testing.T) {
+	config := defaultServerConfig()
+	cm := new(ChallengeMessage)
+	cm.Signature = []byte("NTLMSSP\x00")
+	cm.MessageType = 2
+	cm.TargetName, _ = CreateStringPayload("")
+	cm.NegotiateFlags = NTLMSSP_NEGOTIATE_TARGET_INFO.Set(NTLMSSP_NEGOTIATE_UNICODE.Set(0))
+	cm.ServerChallenge = make([]byte, 8)
+	cm.TargetInfoPayloadStruct, _ = CreateBytePayload(config.targetInfo().Bytes())
+	data := cm.Bytes()
+
+	if _, err := ParseChallengeMessage(data[:len(data)-1]); err == nil {
+		t.Error("Target info that runs past the end of the message should be an error")
+	}
+
+	// A target info without the final AV_PAIR header is also truncated
+	cm.TargetInfoPayloadStruct, _ = CreateBytePayload(config.targetInfo().Bytes()[:2])
+	if _, err := ParseChallengeMessage(cm.Bytes()); err == nil {
+		t.Error("Truncated AV_PAIR should be an error")
+	}
+}
+
+func TestChallengeRoundTrip(t *testing.T) {
+	server := new(V2ServerSession)
+	cm, _ := server.GenerateChallengeMessage()
+
+	// Move the target info in front of the target name, with a non-zero context
+	cm.TargetName, _ = CreateStringPayload("TARGET")
+	cm.NegotiateFlags = NTLMSSP_REQUEST_TARGET.Set(cm.NegotiateFlags)
+	data := cm.Bytes()
+	targetName := cm.TargetName.Payload
+	targetInfo := cm.TargetInfoPayloadStruct.Payload
+	payloadOffset := len(data) - len(targetName) - len(targetInfo)
+	reordered := concat(data[:payloadOffset], targetInfo, targetName)
+	binary.LittleEndian.PutUint32(reordered[16:20], uint32(payloadOffset+len(targetInfo)))
+	binary.LittleEndian.PutUint32(reordered[44:48], uint32(payloadOffset))
+	copy(reordered[32:40], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	parsed, err := ParseChallengeMessage(reordered)
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+	if !bytes.Equal(parsed.Bytes(), reordered) {
+		t.Error("Unchanged message should be serialized as it was received")
+	}
+
+	parsed.ServerChallenge = make([]byte, 8)
+	relaid := parsed.Bytes()
+	if bytes.Equal(relaid, reordered) || !bytes.Equal(relaid[payloadOffset:], concat(targetName, targetInfo)) {
+		t.Error("Edited message should be laid out again")
+	}
+	if !bytes.Equal(relaid[32:40], []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Error("Edited message should keep its context")
+	}
+}
+
+func TestChallengeTargetInfoEdit(t *testing.T) {
+	server := new(V2ServerSession)
+	server.SetServerConfig(&ServerConfig{NetBIOSComputerName: "SERVER", NetBIOSDomainName: "EXAMPLE"})
+	cm, _ := server.GenerateChallengeMessage()
+	data := cm.Bytes()
+
+	parsed, err := ParseChallengeMessage(data)
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+	parsed.TargetInfo.SetOrReplace(MsvAvDnsComputerName, utf16FromString("server.example.com"))
+	parsed.TargetInfo.Remove(MsvAvNbDomainName)
+	edited := parsed.Bytes()
+	if bytes.Equal(edited, data) {
+		t.Fatal("Message with changed AV_PAIRs should be laid out again")
+	}
+
+	reparsed, err := ParseChallengeMessage(edited)
+	if err != nil {
+		t.Fatalf("Could not parse edited challenge message: %s", err)
+	}
+	if reparsed.TargetInfo.StringValue(MsvAvDnsComputerName) != "server.example.com" || reparsed.TargetInfo.Find(MsvAvNbDomainName) != nil {
+		t.Errorf("Changed AV_PAIRs are not in the message got %s", reparsed.TargetInfo)
+	}
+	if reparsed.TargetInfo.StringValue(MsvAvNbComputerName) != "SERVER" || !bytes.Equal(reparsed.ServerChallenge, cm.ServerChallenge) {
+		t.Errorf("Other fields should be kept got %s", reparsed)
+	}
+}
@@ -2,10 +2,13 @@
 
 package ntlm
 
-type NegotiateMessage struct {
-	// All bytes of the message
-	Bytes []byte
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
 
+type NegotiateMessage struct {
 	// sig - 8 bytes
 	Signature []byte
 	// message type - 4 bytes
@@ -24,4 +27,166 @@ type NegotiateMessage struct {
 	// payload - variable
 	Payload       []byte
 	PayloadOffset int
+
+	// The bytes of a parsed message, these are needed to calculate the MIC
+	rawBytes []byte
+	// The field values of a parsed message, when they are unchanged Bytes returns the rawBytes
+	parsedFields []byte
+}
+
+func ParseNegotiateMessage(body []byte) (*NegotiateMessage, error) {
+	// Davenport describes a minimal form of the Type 1 message that only carries the signature, type and flags.
+	// Everything after that is optional.
+	if len(body) < 16 {
+		return nil, newError(ErrMalformedMessage, "invalid NTLM negotiate")
+	}
+
+	nm := new(NegotiateMessage)
+
+	nm.Signature = body[0:8]
+	if !bytes.Equal(nm.Signature, []byte("NTLMSSP\x00")) {
+		return nil, newError(ErrMalformedMessage, "Invalid NTLM message signature")
+	}
+
+	nm.MessageType = binary.LittleEndian.Uint32(body[8:12])
+	if nm.MessageType != 1 {
+		return nil, newError(ErrWrongMessageType, "Invalid NTLM message type should be 0x00000001 for negotiate message")
+	}
+
+	nm.NegotiateFlags = binary.LittleEndian.Uint32(body[12:16])
+	offset := 16
+
+	if len(body) >= 32 {
+		var err error
+
+		nm.DomainNameFields, err = ReadOemStringPayload(16, body)
+		if err != nil {
+			return nil, err
+		}
+
+		nm.WorkstationFields, err = ReadOemStringPayload(24, body)
+		if err != nil {
+			return nil, err
+		}
+
+		offset = 32
+
+		// The version field is there unless the payload starts right after the workstation fields, which is the case
+		// for messages from systems that predate the VERSION structure. It is zero when the flag is not set.
+		if len(body) >= 40 && nm.getLowestPayloadOffset() >= 40 {
+			if NTLMSSP_NEGOTIATE_VERSION.IsSet(nm.NegotiateFlags) {
+				nm.Version, err = ReadVersionStruct(body[offset : offset+8])
+				if err != nil {
+					return nil, err
+				}
+			}
+			offset = offset + 8
+		}
+	}
+
+	nm.PayloadOffset = offset
+	nm.Payload = body[offset:]
+	nm.rawBytes = body
+	nm.parsedFields = nm.fieldValues()
+
+	return nm, nil
+}
+
+func (n *NegotiateMessage) getLowestPayloadOffset() int {
+	payloadStructs := [...]*PayloadStruct{n.DomainNameFields, n.WorkstationFields}
+
+	// Find the lowest offset value
+	lowest := 9999
+	for i := range payloadStructs {
+		p := payloadStructs[i]
+		if p != nil && p.Len > 0 && int(p.Offset) < lowest {
+			lowest = int(p.Offset)
+		}
+	}
+
+	return lowest
+}
+
+func (n *NegotiateMessage) fieldValues() []byte {
+	return fieldValues(n.NegotiateFlags, n.DomainNameFields, n.WorkstationFields, n.Version)
+}
+
+// Bytes returns the bytes of a parsed message as they were received as long as its fields were not changed,
+// otherwise the message is laid out again
+func (n *NegotiateMessage) Bytes() []byte {
+	if n.rawBytes != nil && bytes.Equal(n.fieldValues(), n.parsedFields) {
+		return concat(n.rawBytes)
+	}
+
+	if n.DomainNameFields == nil {
+		n.DomainNameFields, _ = CreateOemStringPayload("")
+	}
+	if n.WorkstationFields == nil {
+		n.WorkstationFields, _ = CreateOemStringPayload("")
+	}
+
+	messageLen := 8 + 4 + 4 + 8 + 8 + 8
+	payloadLen := int(n.DomainNameFields.Len + n.WorkstationFields.Len)
+	payloadOffset := uint32(messageLen)
+
+	messageBytes := make([]byte, 0, messageLen+payloadLen)
+	buffer := bytes.NewBuffer(messageBytes)
+
+	buffer.Write([]byte("NTLMSSP\x00"))
+	binary.Write(buffer, binary.LittleEndian, uint32(1))
+	binary.Write(buffer, binary.LittleEndian, n.NegotiateFlags)
+
+	// Windows leaves the offset of fields that are not supplied at 0
+	if n.DomainNameFields.Len > 0 {
+		n.DomainNameFields.Offset = payloadOffset
+	}
+	buffer.Write(n.DomainNameFields.Bytes())
+	payloadOffset += uint32(n.DomainNameFields.Len)
+
+	if n.WorkstationFields.Len > 0 {
+		n.WorkstationFields.Offset = payloadOffset
+	}
+	buffer.Write(n.WorkstationFields.Bytes())
+	payloadOffset += uint32(n.WorkstationFields.Len)
+
+	// The version field is always there, it is zero unless NTLMSSP_NEGOTIATE_VERSION is set
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(n.NegotiateFlags) && n.Version != nil {
+		buffer.Write(n.Version.Bytes())
+	} else {
+		buffer.Write(make([]byte, 8))
+	}
+
+	// Write out the payloads
+	buffer.Write(n.DomainNameFields.Payload)
+	buffer.Write(n.WorkstationFields.Payload)
+
+	return buffer.Bytes()
+}
+
+// Returns the message as it was received, or the serialized message if it was not parsed
+func (n *NegotiateMessage) wireBytes() []byte {
+	if n.rawBytes != nil {
+		return n.rawBytes
+	}
+	return n.Bytes()
+}
+
+func (n *NegotiateMessage) String() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("Negotiate NTLM Message")
+	buffer.WriteString(fmt.Sprintf("\nPayload Offset: %d Length: %d", n.PayloadOffset, len(n.Payload)))
+	if n.DomainNameFields != nil {
+		buffer.WriteString(fmt.Sprintf("\nDomainName: %s", n.DomainNameFields.String()))
+	}
+	if n.WorkstationFields != nil {
+		buffer.WriteString(fmt.Sprintf("\nWorkstation: %s", n.WorkstationFields.String()))
+	}
+	if n.Version != nil {
+		buffer.WriteString(fmt.Sprintf("\nVersion: %s", n.Version.String()))
+	}
+	buffer.WriteString(fmt.Sprintf("\nFlags %d\n", n.NegotiateFlags))
+	buffer.WriteString(FlagsToString(n.NegotiateFlags))
+
+	return buffer.String()
 }
@@ -0,0 +1,122 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeNegotiate(t *testing.T) {
+	negotiateMessage := "TlRMTVNTUAABAAAAB4IIogAAAAAAAAAAAAAAAAAAAAAKAGFKAAAADw=="
+	negotiateData, err := base64.StdEncoding.DecodeString(negotiateMessage)
+	if err != nil {
+		t.Error("Could not base64 decode message data")
+	}
+
+	nm, err := ParseNegotiateMessage(negotiateData)
+	if err != nil || nm == nil {
+		t.Fatalf("Failed to parse negotiate message: %s", err)
+	}
+
+	if nm.NegotiateFlags != uint32(0xa2088207) {
+		t.Errorf("Negotiate flags not correct should be %d got %d", uint32(0xa2088207), nm.NegotiateFlags)
+	}
+
+	if nm.Version == nil || nm.Version.ProductMajorVersion != 10 || nm.Version.ProductBuild != 19041 || nm.Version.NTLMRevisionCurrent != 15 {
+		t.Errorf("Version information is not correct: '%v'", nm.Version)
+	}
+
+	if nm.DomainNameFields.Len != 0 || nm.WorkstationFields.Len != 0 {
+		t.Error("Domain and workstation should be empty")
+	}
+
+	_ = nm.String()
+
+	if !bytes.Equal(nm.Bytes(), negotiateData) {
+		t.Error("Negotiate message bytes are not the same after a round trip")
+	}
+}
+
+func TestParseNegotiateMinimalMessage(t *testing.T) {
+	// The minimal form of the Type 1 message as described by Davenport: signature, type and flags only
+	data := []byte("NTLMSSP\x00\x01\x00\x00\x00\x07\x82\x00\x00")
+	nm, err := ParseNegotiateMessage(data)
+	if err != nil {
+		t.Fatalf("Could not parse minimal negotiate message: %s", err)
+	}
+	if nm.DomainNameFields != nil || nm.Version != nil {
+		t.Error("Minimal negotiate message should not have domain or version information")
+	}
+}
+
+func TestParseNegotiateInvalidMessage(t *testing.T) {
+	_, err := ParseNegotiateMessage(nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	_, err = ParseNegotiateMessage([]byte("NTLMSSP\x00\x02\x00\x00\x00\x07\x82\x00\x00"))
+	if err == nil {
+		t.Error("expected error for the wrong message type, got nil")
+	}
+}
+
+func TestGenerateNegotiateMessage(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		client, err := CreateClientSession(version, ConnectionOrientedMode)
+		if err != nil {
+			t.Fatalf("Could not create client session: %s", err)
+		}
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+
+		nm, err := client.GenerateNegotiateMessage()
+		if err != nil || nm == nil {
+			t.Fatalf("Could not generate negotiate message: %s", err)
+		}
+
+		if !NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED.IsSet(nm.NegotiateFlags) || !NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.IsSet(nm.NegotiateFlags) {
+			t.Error("Domain and workstation supplied flags should be set")
+		}
+
+		reparsed, err := ParseNegotiateMessage(nm.Bytes())
+		if err != nil {
+			t.Fatalf("Could not re-parse negotiate message: %s", err)
+		}
+		if reparsed.DomainNameFields.String() != "Domain" || reparsed.WorkstationFields.String() != "COMPUTER" {
+			t.Errorf("Domain or workstation not correct got %s and %s", reparsed.DomainNameFields.String(), reparsed.WorkstationFields.String())
+		}
+		if reparsed.NegotiateFlags != nm.NegotiateFlags || reparsed.Version.String() != nm.Version.String() {
+			t.Error("Reparsed message is not the same")
+		}
+	}
+
+	client := new(V2ClientSession)
+	flags := NTLMSSP_NEGOTIATE_UNICODE.Set(NTLMSSP_NEGOTIATE_NTLM.Set(0))
+	client.SetRequestedFlags(flags)
+	nm, _ := client.GenerateNegotiateMessage()
+	if nm.NegotiateFlags != flags {
+		t.Errorf("Requested flags not used, expected %d got %d", flags, nm.NegotiateFlags)
+	}
+	data := nm.Bytes()
+	if len(data) != 40 || !bytes.Equal(data[32:40], zeroBytes(8)) {
+		t.Errorf("Negotiate message without the version flag should have a zero version field got %x", data)
+	}
+
+	// A version without the flag is not sent
+	nm.Version = NewVersionStruct(10, 0, 17763)
+	reparsed, err := ParseNegotiateMessage(nm.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse negotiate message: %s", err)
+	}
+	if reparsed.Version != nil || len(reparsed.Bytes()) != 40 {
+		t.Errorf("Version should only be sent with NTLMSSP_NEGOTIATE_VERSION got %s", reparsed.Version)
+	}
+
+	// Older clients leave the version field out
+	reparsed, err = ParseNegotiateMessage(data[:32])
+	if err != nil || reparsed.Version != nil || reparsed.PayloadOffset != 32 {
+		t.Errorf("Negotiate message without a version field should be accepted: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	for _, version := range []Version{Version1, Version2} {
+		client, _ := CreateClientSession(version, ConnectionOrientedMode)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		server, _ := CreateServerSession(version, ConnectionOrientedMode)
+		server.SetUserInfo("User", "Password", "Domain", "")
+
+		nm, _ := client.GenerateNegotiateMessage()
+		server.ProcessNegotiateMessage(nm)
+		cm, _ := server.GenerateChallengeMessage()
+		client.ProcessChallengeMessage(cm)
+		am, _ := client.GenerateAuthenticateMessage()
+
+		for _, expected := range []Message{nm, cm, am} {
+			message, err := ParseMessage(expected.Bytes())
+			if err != nil {
+				t.Fatalf("Could not parse %s: %s", expected.Type(), err)
+			}
+			if message.Type() != expected.Type() || message.Flags() != expected.Flags() || !bytes.Equal(message.Bytes(), expected.Bytes()) {
+				t.Errorf("Parsed %s is not the same", expected.Type())
+			}
+		}
+
+		message, _ := ParseMessage(am.Bytes())
+		if err := server.ProcessAuthenticateMessage(message.(*AuthenticateMessage)); err != nil {
+			t.Errorf("NTLMv%d authenticate message parsed with ParseMessage could not be processed: %s", version, err)
+		}
+	}
+}
+
+func TestParseMessageInvalid(t *testing.T) {
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{nil, ErrMalformedMessage},
+		{[]byte("NTLMSSX\x00\x01\x00\x00\x00\x07\x82\x00\x00"), ErrMalformedMessage},
+		{[]byte("NTLMSSP\x00\x04\x00\x00\x00\x07\x82\x00\x00"), ErrWrongMessageType},
+		{[]byte("NTLMSSP\x00\x03\x00\x00\x00"), ErrMalformedMessage},
+	}
+
+	for _, test := range tests {
+		message, err := ParseMessage(test.data)
+		if message != nil || !errors.Is(err, test.err) {
+			t.Errorf("Expected error %v for %q got %v", test.err, test.data, err)
+		}
+	}
+}
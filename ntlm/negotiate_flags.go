@@ -140,6 +140,76 @@ func (f NegotiateFlag) String() string {
 	return reflect.TypeOf(f).Name()
 }
 
+// NegotiateChallengeFlags combines the flags a client requested in its NEGOTIATE_MESSAGE with the capabilities of
+// the server into the flags of the CHALLENGE_MESSAGE, following the rules of MS-NLMP 2.2.2.5 and 3.2.5.1.1.
+// NTLMSSP_NEGOTIATE_NTLM, TARGET_INFO, VERSION, DATAGRAM and the target type are decided by the server alone.
+func NegotiateChallengeFlags(requested, capabilities uint32) (uint32, error) {
+	flags := uint32(0)
+
+	// These are returned when the client asks for them and the server supports them
+	shared := [...]NegotiateFlag{
+		NTLMSSP_NEGOTIATE_SIGN,
+		NTLMSSP_NEGOTIATE_SEAL,
+		NTLMSSP_NEGOTIATE_ALWAYS_SIGN,
+		NTLMSSP_NEGOTIATE_LM_KEY,
+		NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY,
+		NTLMSSP_NEGOTIATE_IDENTIFY,
+		NTLMSSP_REQUEST_NON_NT_SESSION_KEY,
+		NTLMSSP_NEGOTIATE_KEY_EXCH,
+		NTLMSSP_NEGOTIATE_56,
+		NTLMSSP_NEGOTIATE_128}
+	for _, f := range shared {
+		if f.IsSet(requested) && f.IsSet(capabilities) {
+			flags = f.Set(flags)
+		}
+	}
+
+	serverOnly := [...]NegotiateFlag{
+		NTLMSSP_NEGOTIATE_NTLM,
+		NTLMSSP_NEGOTIATE_TARGET_INFO,
+		NTLMSSP_NEGOTIATE_VERSION,
+		NTLMSSP_NEGOTIATE_DATAGRAM,
+		NTLMSSP_TARGET_TYPE_DOMAIN,
+		NTLMSSP_TARGET_TYPE_SERVER}
+	for _, f := range serverOnly {
+		if f.IsSet(capabilities) {
+			flags = f.Set(flags)
+		}
+	}
+
+	if NTLMSSP_REQUEST_TARGET.IsSet(requested) {
+		flags = NTLMSSP_REQUEST_TARGET.Set(flags)
+	}
+
+	// LM_KEY and EXTENDED_SESSIONSECURITY are mutually exclusive, extended session security wins
+	if NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(flags) {
+		flags = NTLMSSP_NEGOTIATE_LM_KEY.Unset(flags)
+	}
+
+	// The key strength is only returned when the client signs or seals
+	if !NTLMSSP_NEGOTIATE_SIGN.IsSet(flags) && !NTLMSSP_NEGOTIATE_SEAL.IsSet(flags) {
+		flags = NTLMSSP_NEGOTIATE_56.Unset(flags)
+		flags = NTLMSSP_NEGOTIATE_128.Unset(flags)
+	}
+
+	// Connectionless NTLM always exchanges keys
+	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(flags) {
+		flags = NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
+	}
+
+	// Unicode is preferred, OEM is only used when the client or the server can't do Unicode
+	switch {
+	case NTLMSSP_NEGOTIATE_UNICODE.IsSet(requested) && NTLMSSP_NEGOTIATE_UNICODE.IsSet(capabilities):
+		flags = NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	case NTLM_NEGOTIATE_OEM.IsSet(requested) && NTLM_NEGOTIATE_OEM.IsSet(capabilities):
+		flags = NTLM_NEGOTIATE_OEM.Set(flags)
+	default:
+		return 0, newError(ErrNegotiationFailure, "Client and server do not support a common character set")
+	}
+
+	return flags, nil
+}
+
 func GetFlagName(flag NegotiateFlag) string {
 	nameMap := map[NegotiateFlag]string{
 		NTLMSSP_NEGOTIATE_56:                       "NTLMSSP_NEGOTIATE_56",
@@ -29,3 +29,60 @@ func TestFlags(t *testing.T) {
 		t.Error("NTLM Flags are not correct")
 	}
 }
+
+func TestNegotiateChallengeFlags(t *testing.T) {
+	capabilities := defaultV2ServerFlags()
+	capabilities = NTLMSSP_NEGOTIATE_LM_KEY.Set(capabilities)
+
+	// LM_KEY and EXTENDED_SESSIONSECURITY both requested, only extended session security is returned
+	requested := uint32(0)
+	requested = NTLMSSP_NEGOTIATE_LM_KEY.Set(requested)
+	requested = NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(requested)
+	requested = NTLMSSP_NEGOTIATE_SIGN.Set(requested)
+	requested = NTLMSSP_NEGOTIATE_128.Set(requested)
+	requested = NTLMSSP_NEGOTIATE_UNICODE.Set(requested)
+	flags, err := NegotiateChallengeFlags(requested, capabilities)
+	if err != nil {
+		t.Fatalf("Could not negotiate flags: %s", err)
+	}
+	if NTLMSSP_NEGOTIATE_LM_KEY.IsSet(flags) || !NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(flags) {
+		t.Error("Only extended session security should be returned")
+	}
+	if !NTLMSSP_NEGOTIATE_SIGN.IsSet(flags) || NTLMSSP_NEGOTIATE_SEAL.IsSet(flags) {
+		t.Error("SIGN should be echoed and SEAL should not be returned")
+	}
+	if !NTLMSSP_NEGOTIATE_128.IsSet(flags) || NTLMSSP_NEGOTIATE_56.IsSet(flags) {
+		t.Error("Only the requested key strength should be returned")
+	}
+	if !NTLMSSP_NEGOTIATE_NTLM.IsSet(flags) || !NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(flags) {
+		t.Error("NTLM and TARGET_INFO should be set by the server")
+	}
+
+	// Without SIGN or SEAL the key strength is not returned
+	requested = NTLMSSP_NEGOTIATE_SIGN.Unset(requested)
+	flags, _ = NegotiateChallengeFlags(requested, capabilities)
+	if NTLMSSP_NEGOTIATE_128.IsSet(flags) {
+		t.Error("128 should only be returned with SIGN or SEAL")
+	}
+
+	// LM_KEY alone is returned when the server supports it
+	requested = NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Unset(requested)
+	flags, _ = NegotiateChallengeFlags(requested, capabilities)
+	if !NTLMSSP_NEGOTIATE_LM_KEY.IsSet(flags) {
+		t.Error("LM_KEY should be returned")
+	}
+
+	// Character set selection
+	flags, _ = NegotiateChallengeFlags(NTLM_NEGOTIATE_OEM.Set(NTLMSSP_NEGOTIATE_UNICODE.Set(0)), capabilities)
+	if !NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags) || NTLM_NEGOTIATE_OEM.IsSet(flags) {
+		t.Error("Unicode should be selected when both sides support it")
+	}
+	flags, _ = NegotiateChallengeFlags(NTLM_NEGOTIATE_OEM.Set(0), capabilities)
+	if NTLMSSP_NEGOTIATE_UNICODE.IsSet(flags) || !NTLM_NEGOTIATE_OEM.IsSet(flags) {
+		t.Error("OEM should be selected when the client does not support Unicode")
+	}
+	_, err = NegotiateChallengeFlags(NTLM_NEGOTIATE_OEM.Set(0), NTLM_NEGOTIATE_OEM.Unset(capabilities))
+	if err == nil {
+		t.Error("expected error when there is no common character set, got nil")
+	}
+}
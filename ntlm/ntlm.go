@@ -6,14 +6,16 @@ package ntlm
 
 import (
 	rc4P "crypto/rc4"
-	"errors"
+	"fmt"
 )
 
 type Version int
 
 const (
-	Version1 Version = 1
-	Version2 Version = 2
+	// Only for servers and ParseAuthenticateMessage: the version is detected from the response of the client
+	VersionAuto Version = 0
+	Version1    Version = 1
+	Version2    Version = 2
 )
 
 type Mode int
@@ -33,37 +35,57 @@ func CreateClientSession(version Version, mode Mode) (n ClientSession, err error
 	case Version2:
 		n = new(V2ClientSession)
 	default:
-		return nil, errors.New("Unknown NTLM Version, must be 1 or 2")
+		return nil, newError(ErrInvalidParameter, "Unknown NTLM Version, must be 1 or 2")
 	}
 
+	n.SetMode(mode)
 	return n, nil
 }
 
 type ClientSession interface {
 	SetUserInfo(username string, password string, domain string, workstation string)
+	SetUserHash(username string, ntHash []byte, lmHash []byte, domain string, workstation string) error
+	SetAnonymous()
 	SetMode(mode Mode)
+	SetRequestedFlags(flags uint32)
+	SetChannelBindings(bindings *ChannelBindings)
+	SetSingleHostData(data *SingleHostData)
+	SetProductVersion(version *VersionStruct)
+	SetOemCodePage(codePage *CodePage)
+	SetLogger(logger Logger)
+	SetLogIdentities(logIdentities bool)
 
 	GenerateNegotiateMessage() (*NegotiateMessage, error)
 	ProcessChallengeMessage(*ChallengeMessage) error
 	GenerateAuthenticateMessage() (*AuthenticateMessage, error)
 
-	Seal(message []byte) ([]byte, error)
+	// Connection oriented sessions keep track of the sequence numbers
+	Seal(message []byte) ([]byte, []byte, error)
+	Unseal(message, signature []byte) ([]byte, error)
 	Sign(message []byte) ([]byte, error)
-	Mac(message []byte, sequenceNumber int) ([]byte, error)
-	VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error)
+	VerifySignature(message, signature []byte) error
+	// Connectionless sessions use the sequence number the application supplies with each message
+	SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error)
+	UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error)
+	SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error)
+	VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error
+	Mac(message []byte) ([]byte, error)
+	VerifyMac(message, expectedMac []byte) (bool, error)
 }
 
-// Creates an NTLM v1 or v2 server
+// Creates an NTLM v1 or v2 server, or a server that accepts both
 // mode - This must be ConnectionlessMode or ConnectionOrientedMode depending on what type of NTLM is used
-// version - This must be Version1 or Version2 depending on the version of NTLM used
+// version - This must be Version1, Version2 or VersionAuto depending on the version of NTLM used
 func CreateServerSession(version Version, mode Mode) (n ServerSession, err error) {
 	switch version {
+	case VersionAuto:
+		n = new(AutoServerSession)
 	case Version1:
 		n = new(V1ServerSession)
 	case Version2:
 		n = new(V2ServerSession)
 	default:
-		return nil, errors.New("Unknown NTLM Version, must be 1 or 2")
+		return nil, newError(ErrInvalidParameter, "Unknown NTLM Version, must be 1, 2 or auto")
 	}
 
 	n.SetMode(mode)
@@ -76,6 +98,20 @@ type ServerSession interface {
 
 	SetMode(mode Mode)
 	SetServerChallenge(challenge []byte)
+	SetChallengeMessage(cm *ChallengeMessage)
+	SetChannelBindings(bindings *ChannelBindings)
+	SetChannelBindingPolicy(policy ChannelBindingPolicy)
+	SetServerCapabilities(flags uint32)
+	SetServerConfig(config *ServerConfig)
+	SetCredentialProvider(provider CredentialProvider)
+	SetAllowAnonymous(allow bool)
+	SetMachineID(machineID []byte)
+	SetProductVersion(version *VersionStruct)
+	SetOemCodePage(codePage *CodePage)
+	SetLogger(logger Logger)
+	SetLogIdentities(logIdentities bool)
+	IsAnonymous() bool
+	IsLoopback() bool
 
 	ProcessNegotiateMessage(*NegotiateMessage) error
 	GenerateChallengeMessage() (*ChallengeMessage, error)
@@ -83,11 +119,20 @@ type ServerSession interface {
 
 	GetSessionData() *SessionData
 
+	// Version returns 1 or 2, an AutoServerSession returns 0 until it accepted an AUTHENTICATE_MESSAGE
 	Version() int
-	Seal(message []byte) ([]byte, error)
+	// Connection oriented sessions keep track of the sequence numbers
+	Seal(message []byte) ([]byte, []byte, error)
+	Unseal(message, signature []byte) ([]byte, error)
 	Sign(message []byte) ([]byte, error)
-	Mac(message []byte, sequenceNumber int) ([]byte, error)
-	VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error)
+	VerifySignature(message, signature []byte) error
+	// Connectionless sessions use the sequence number the application supplies with each message
+	SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error)
+	UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error)
+	SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error)
+	VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error
+	Mac(message []byte) ([]byte, error)
+	VerifyMac(message, expectedMac []byte) (bool, error)
 }
 
 // This struct collects NTLM data structures and keys that are used across all types of NTLM requests
@@ -100,6 +145,34 @@ type SessionData struct {
 	workstation string
 
 	NegotiateFlags uint32
+	// The flags a client asks for in its NEGOTIATE_MESSAGE, when 0 the client uses its default set
+	requestedFlags uint32
+	// The channel bindings a client sends in the MsvChannelBindings AV_PAIR, or a server expects to receive in it
+	channelBindings      *ChannelBindings
+	channelBindingPolicy ChannelBindingPolicy
+	// The flags a server supports, when 0 the server uses its default set
+	serverCapabilities uint32
+	serverConfig       *ServerConfig
+	credentials        CredentialProvider
+	productVersion     *VersionStruct
+	// The code page of the names when only OEM is negotiated, when nil CodePage437 is used
+	codePage *CodePage
+
+	// The NT and LM hashes of the user, used instead of the password when they are set
+	ntHash []byte
+	lmHash []byte
+
+	// Set on clients that authenticate anonymously and on servers that accepted an anonymous client
+	anonymous      bool
+	allowAnonymous bool
+
+	logger        Logger
+	logIdentities bool
+
+	// The Single_Host_Data a client sends, and the MachineID a server compares it with
+	singleHostData *SingleHostData
+	machineID      []byte
+	loopback       bool
 
 	negotiateMessage    *NegotiateMessage
 	challengeMessage    *ChallengeMessage
@@ -125,4 +198,179 @@ type SessionData struct {
 
 	clientHandle *rc4P.Cipher
 	serverHandle *rc4P.Cipher
+
+	// In connection oriented mode each direction keeps its own sequence number
+	clientSeqNum uint32
+	serverSeqNum uint32
+}
+
+// SetChannelBindings sets the channel bindings of the TLS connection that carries the authentication. NTLMv2 clients
+// send their hash in the MsvChannelBindings AV_PAIR, NTLMv1 has no place to send them. Servers compare the hash
+// sent by the client with these bindings according to their ChannelBindingPolicy.
+func (n *SessionData) SetChannelBindings(bindings *ChannelBindings) {
+	n.channelBindings = bindings
+}
+
+// SetChannelBindingPolicy sets how a server checks the channel bindings of the client. The default is
+// ChannelBindingOff. NTLMv1 clients never send channel bindings so they fail with ChannelBindingRequire.
+func (n *SessionData) SetChannelBindingPolicy(policy ChannelBindingPolicy) {
+	n.channelBindingPolicy = policy
+}
+
+// SetServerCapabilities sets the flags a server supports. The flags of the CHALLENGE_MESSAGE are negotiated from
+// these and the flags of the client's NEGOTIATE_MESSAGE. If no flags are set the server session uses a default set
+// of flags for its NTLM version. NTLMSSP_NEGOTIATE_DATAGRAM is always set from the mode of the session.
+func (n *SessionData) SetServerCapabilities(flags uint32) {
+	n.serverCapabilities = flags
+}
+
+func (n *SessionData) capabilities(defaultFlags uint32) uint32 {
+	if n.serverCapabilities == 0 {
+		return defaultFlags
+	}
+	return n.serverCapabilities
+}
+
+// Negotiates the flags of the CHALLENGE_MESSAGE. In connectionless mode there is no NEGOTIATE_MESSAGE and the
+// server offers everything it supports, the client picks from these in its AUTHENTICATE_MESSAGE.
+func (n *SessionData) challengeFlags(defaultFlags uint32) (uint32, error) {
+	capabilities := n.capabilities(defaultFlags)
+	if n.mode == ConnectionlessMode {
+		capabilities = NTLMSSP_NEGOTIATE_DATAGRAM.Set(capabilities)
+	} else {
+		capabilities = NTLMSSP_NEGOTIATE_DATAGRAM.Unset(capabilities)
+	}
+
+	requested := capabilities
+	if n.negotiateMessage != nil {
+		requested = n.negotiateMessage.NegotiateFlags
+	}
+	return NegotiateChallengeFlags(requested, capabilities)
+}
+
+// The flags that decide how the keys are made and how messages are protected
+const securityFlags = uint32(NTLMSSP_NEGOTIATE_KEY_EXCH | NTLMSSP_NEGOTIATE_SIGN | NTLMSSP_NEGOTIATE_SEAL |
+	NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY | NTLMSSP_NEGOTIATE_128 | NTLMSSP_NEGOTIATE_56 | NTLMSSP_NEGOTIATE_LM_KEY |
+	NTLMSSP_NEGOTIATE_DATAGRAM)
+
+// Takes the flags of the AUTHENTICATE_MESSAGE. The client can leave out security flags the server offered in its
+// CHALLENGE_MESSAGE, but not add ones that were not negotiated. Clients often echo other flags, like OEM next to
+// UNICODE or the target type, these are not compared. Without the CHALLENGE_MESSAGE, when the server challenge was
+// set with SetServerChallenge, the flags can't be compared.
+func (n *SessionData) authenticateFlags(am *AuthenticateMessage) (uint32, error) {
+	if n.challengeMessage == nil {
+		return am.NegotiateFlags, nil
+	}
+
+	if extra := am.NegotiateFlags & securityFlags &^ n.challengeMessage.NegotiateFlags; extra != 0 {
+		return 0, newError(ErrLogonFailure, fmt.Sprintf("Authenticate message has flags 0x%08X that were not negotiated", extra))
+	}
+	return am.NegotiateFlags, nil
+}
+
+// SetRequestedFlags sets the flags the client sends in the NEGOTIATE_MESSAGE. If no flags are set
+// the client session uses a default set of flags for its NTLM version.
+func (n *SessionData) SetRequestedFlags(flags uint32) {
+	n.requestedFlags = flags
+}
+
+// Builds the NEGOTIATE_MESSAGE for a client session. The domain and workstation are only sent when they
+// are known, which is indicated with the OEM_DOMAIN_SUPPLIED and OEM_WORKSTATION_SUPPLIED flags.
+func (n *SessionData) generateNegotiateMessage(defaultFlags uint32) *NegotiateMessage {
+	nm := new(NegotiateMessage)
+	nm.Signature = []byte("NTLMSSP\x00")
+	nm.MessageType = uint32(1)
+
+	flags := n.requestedFlags
+	if flags == 0 {
+		flags = defaultFlags
+		if n.mode == ConnectionlessMode {
+			flags = NTLMSSP_NEGOTIATE_DATAGRAM.Set(flags)
+		}
+	}
+
+	flags = NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED.Unset(flags)
+	if n.userDomain != "" {
+		flags = NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED.Set(flags)
+		nm.DomainNameFields = n.createOemStringPayload(n.userDomain)
+	} else {
+		nm.DomainNameFields, _ = CreateOemStringPayload("")
+	}
+
+	flags = NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.Unset(flags)
+	if n.workstation != "" {
+		flags = NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED.Set(flags)
+		nm.WorkstationFields = n.createOemStringPayload(n.workstation)
+	} else {
+		nm.WorkstationFields, _ = CreateOemStringPayload("")
+	}
+
+	nm.NegotiateFlags = flags
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(flags) {
+		nm.Version = n.localVersion()
+	}
+
+	n.negotiateMessage = nm
+	return nm
+}
+
+// Builds the CHALLENGE_MESSAGE for a server session with a new random server challenge and the identity from
+// the ServerConfig. The TargetInfo fields are only filled in when NTLMSSP_NEGOTIATE_TARGET_INFO is part of the flags.
+func (n *SessionData) generateChallengeMessage(flags uint32) *ChallengeMessage {
+	config := n.config()
+
+	cm := new(ChallengeMessage)
+	cm.Signature = []byte("NTLMSSP\x00")
+	cm.MessageType = uint32(2)
+
+	// The TargetName is only supplied when the client asked for it
+	if NTLMSSP_REQUEST_TARGET.IsSet(flags) && config.TargetName != "" {
+		cm.TargetName = n.createStringPayload(config.TargetName, flags)
+		if config.TargetType != 0 {
+			flags = config.TargetType.Set(flags)
+		}
+	} else {
+		cm.TargetName, _ = CreateBytePayload(make([]byte, 0))
+	}
+	cm.NegotiateFlags = flags
+
+	n.serverChallenge = randomBytes(8)
+	cm.ServerChallenge = n.serverChallenge
+	cm.Reserved = make([]byte, 8)
+
+	if NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(flags) {
+		pairs := config.targetInfo()
+		cm.TargetInfo = pairs
+		cm.TargetInfoPayloadStruct, _ = CreateBytePayload(pairs.Bytes())
+	} else {
+		cm.TargetInfoPayloadStruct, _ = CreateBytePayload(make([]byte, 0))
+	}
+
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(flags) {
+		cm.Version = n.localVersion()
+	}
+
+	n.challengeMessage = cm
+	return cm
+}
+
+// SetChallengeMessage restores the CHALLENGE_MESSAGE a server sent, together with its server challenge. Servers that
+// don't keep the session between the requests of a handshake use it to verify the MIC of the AUTHENTICATE_MESSAGE.
+// The message should be parsed from the bytes that were sent, so the MIC is calculated over exactly these bytes.
+func (n *SessionData) SetChallengeMessage(cm *ChallengeMessage) {
+	n.challengeMessage = cm
+	n.serverChallenge = cm.ServerChallenge
+}
+
+// Calculates the MIC over the messages of the handshake. The AUTHENTICATE_MESSAGE bytes must have the MIC set
+// to zero. In connectionless mode there is no NEGOTIATE_MESSAGE, so it is left out of the calculation.
+func (n *SessionData) calculateMic(authenticateBytes []byte) []byte {
+	var negotiateBytes, challengeBytes []byte
+	if n.negotiateMessage != nil {
+		negotiateBytes = n.negotiateMessage.wireBytes()
+	}
+	if n.challengeMessage != nil {
+		challengeBytes = n.challengeMessage.wireBytes()
+	}
+	return hmacMd5(n.exportedSessionKey, concat(negotiateBytes, challengeBytes, authenticateBytes))
 }
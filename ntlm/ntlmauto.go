@@ -0,0 +1,206 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+// ResponseType identifies the kind of challenge response in an AUTHENTICATE_MESSAGE. The values can be combined
+// into the set of response types an AutoServerSession accepts.
+type ResponseType uint32
+
+const (
+	// Only an LM response, the NT response is empty
+	ResponseLM ResponseType = 1 << iota
+	// A 24 byte NTLMv1 response
+	ResponseNTLMv1
+	// A 24 byte NTLMv1 response with extended session security, also known as the NTLM2 session response
+	ResponseNTLMv1ESS
+	// An NTLMv2 response with its NTLMv2_CLIENT_CHALLENGE
+	ResponseNTLMv2
+	// The anonymous form of the message, allowed with SetAllowAnonymous instead of SetAllowedResponseTypes
+	ResponseAnonymous
+)
+
+// ErrResponseTypeNotAllowed is returned by an AutoServerSession for a response type that was not allowed
+var ErrResponseTypeNotAllowed = newError(ErrPolicyViolation, "NTLM response type is not allowed")
+
+// ResponseType detects the kind of challenge response from the length and structure of the NT response
+func (a *AuthenticateMessage) ResponseType() (ResponseType, error) {
+	ntLen := len(a.NtChallengeResponseFields.Payload)
+	switch {
+	case a.isAnonymous():
+		return ResponseAnonymous, nil
+	case ntLen == 0 && len(a.LmChallengeResponse.Payload) == 24:
+		return ResponseLM, nil
+	case ntLen == 24 && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(a.NegotiateFlags):
+		return ResponseNTLMv1ESS, nil
+	case ntLen == 24:
+		return ResponseNTLMv1, nil
+	case ntLen > 24 && a.NtlmV2Response != nil:
+		return ResponseNTLMv2, nil
+	}
+	return 0, newError(ErrMalformedMessage, "Could not detect the NTLM response type")
+}
+
+/**************
+ Server Session
+**************/
+
+// AutoServerSession is a server session that accepts NTLMv1 and NTLMv2 clients. It detects the response type of
+// the AUTHENTICATE_MESSAGE and verifies it like a V1ServerSession or V2ServerSession would. Create it with
+// CreateServerSession(VersionAuto, mode) and parse the AUTHENTICATE_MESSAGE with
+// ParseAuthenticateMessage(body, int(VersionAuto)).
+type AutoServerSession struct {
+	SessionData
+	allowedResponseTypes ResponseType
+	// The NTLM version of the response the client sent, 0 before the AUTHENTICATE_MESSAGE was processed
+	version int
+}
+
+// The response types an AutoServerSession accepts unless SetAllowedResponseTypes was used
+const defaultResponseTypes = ResponseNTLMv1ESS | ResponseNTLMv2
+
+// SetAllowedResponseTypes sets the response types the server accepts. By default only NTLMv2 and NTLMv1 with
+// extended session security are accepted, LM and plain NTLMv1 responses are rejected.
+func (n *AutoServerSession) SetAllowedResponseTypes(types ResponseType) {
+	n.allowedResponseTypes = types
+}
+
+// SetUserInfo sets the username, password, domain, and workstation for the session
+func (n *AutoServerSession) SetUserInfo(username string, password string, domain string, workstation string) {
+	n.user = username
+	n.password = password
+	n.userDomain = domain
+	n.workstation = workstation
+	n.ntHash = nil
+	n.lmHash = nil
+	n.anonymous = false
+}
+
+func (n *AutoServerSession) GetUserInfo() (string, string, string, string) {
+	return n.user, n.password, n.userDomain, n.workstation
+}
+
+func (n *AutoServerSession) SetMode(mode Mode) {
+	n.mode = mode
+}
+
+// Version returns the NTLM version of the response the client sent. It is 0 until an AUTHENTICATE_MESSAGE was
+// accepted, since the version is only known from the response.
+func (n *AutoServerSession) Version() int {
+	return n.version
+}
+
+func (n *AutoServerSession) GetSessionData() *SessionData {
+	return &n.SessionData
+}
+
+func (n *AutoServerSession) SetServerChallenge(challenge []byte) {
+	n.serverChallenge = challenge
+}
+
+func (n *AutoServerSession) ProcessNegotiateMessage(nm *NegotiateMessage) (err error) {
+	n.negotiateMessage = nm
+	return
+}
+
+// GenerateChallengeMessage offers the capabilities of an NTLMv2 server. Extended session security is only
+// returned when the client asks for it, so NTLMv1 clients without it can still answer.
+func (n *AutoServerSession) GenerateChallengeMessage() (cm *ChallengeMessage, err error) {
+	flags, err := n.challengeFlags(defaultV2ServerFlags())
+	if err != nil {
+		return nil, err
+	}
+	return n.generateChallengeMessage(flags), nil
+}
+
+// ProcessAuthenticateMessage detects the response type and verifies the message with a V1ServerSession or
+// V2ServerSession that shares the state of this session. The keys it derives are copied back.
+func (n *AutoServerSession) ProcessAuthenticateMessage(am *AuthenticateMessage) (err error) {
+	n.version = 0
+	responseType, err := am.ResponseType()
+	if err != nil {
+		return err
+	}
+
+	allowed := n.allowedResponseTypes
+	if allowed == 0 {
+		allowed = defaultResponseTypes
+	}
+	if responseType != ResponseAnonymous && responseType&allowed == 0 {
+		return ErrResponseTypeNotAllowed
+	}
+	n.log(LogDebug, "Detected NTLM response type", "responseType", responseType)
+
+	var session ServerSession
+	switch responseType {
+	case ResponseNTLMv2, ResponseAnonymous:
+		v2 := new(V2ServerSession)
+		v2.SessionData = n.SessionData
+		session = v2
+	default:
+		v1 := new(V1ServerSession)
+		v1.SessionData = n.SessionData
+		session = v1
+	}
+
+	err = session.ProcessAuthenticateMessage(am)
+	n.SessionData = *session.GetSessionData()
+	if err != nil {
+		return err
+	}
+	n.version = session.Version()
+	return nil
+}
+
+// Seal encrypts a message sent by the server and returns it together with its NTLMSSP_MESSAGE_SIGNATURE
+func (n *AutoServerSession) Seal(message []byte) ([]byte, []byte, error) {
+	return n.serverSeal(message, nil)
+}
+
+// SealDatagram encrypts a message of a connectionless session with the sequence number the application supplies
+func (n *AutoServerSession) SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error) {
+	return n.serverSeal(message, &sequenceNumber)
+}
+
+// Unseal decrypts a message sent by the client after checking its NTLMSSP_MESSAGE_SIGNATURE
+func (n *AutoServerSession) Unseal(message, signature []byte) ([]byte, error) {
+	return n.clientUnseal(message, signature, nil)
+}
+
+// UnsealDatagram decrypts a message of a connectionless session with the sequence number the application supplies
+func (n *AutoServerSession) UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.clientUnseal(message, signature, &sequenceNumber)
+}
+
+// Sign returns the detached NTLMSSP_MESSAGE_SIGNATURE of a message sent by the server
+func (n *AutoServerSession) Sign(message []byte) ([]byte, error) {
+	return n.serverSign(message, nil)
+}
+
+// SignDatagram signs a message of a connectionless session with the sequence number the application supplies
+func (n *AutoServerSession) SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.serverSign(message, &sequenceNumber)
+}
+
+// VerifySignature checks the NTLMSSP_MESSAGE_SIGNATURE of a message sent by the client. The error tells
+// if the version, the sequence number or the checksum of the signature is wrong.
+func (n *AutoServerSession) VerifySignature(message, signature []byte) error {
+	return n.clientVerifySignature(message, signature, nil)
+}
+
+// VerifyDatagramSignature checks the signature of a message of a connectionless session with the sequence
+// number the application supplies
+func (n *AutoServerSession) VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error {
+	return n.clientVerifySignature(message, signature, &sequenceNumber)
+}
+
+// Mac computes the signature of a message sent by the server with the sequence number the connection oriented
+// session keeps track of. Connectionless sessions use SignDatagram instead.
+func (n *AutoServerSession) Mac(message []byte) ([]byte, error) {
+	return n.serverMac(message)
+}
+
+// VerifyMac checks the signature of a message sent by the client with the sequence number the connection
+// oriented session keeps track of. Connectionless sessions use VerifyDatagramSignature instead.
+func (n *AutoServerSession) VerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.clientVerifyMac(message, expectedMac)
+}
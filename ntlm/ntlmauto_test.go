@@ -0,0 +1,151 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"testing"
+)
+
+// Runs a handshake between a client and an AutoServerSession, the client version is unknown to the server
+func runAutoHandshake(t *testing.T, client ClientSession, server *AutoServerSession) error {
+	cm, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("Could not generate challenge message: %s", err)
+	}
+	cm, err = ParseChallengeMessage(cm.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+
+	err = client.ProcessChallengeMessage(cm)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+	am, err := client.GenerateAuthenticateMessage()
+	if err != nil {
+		t.Fatalf("Could not generate authenticate message: %s", err)
+	}
+	am, err = ParseAuthenticateMessage(am.Bytes(), int(VersionAuto))
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+
+	return server.ProcessAuthenticateMessage(am)
+}
+
+func TestAutoServerSession(t *testing.T) {
+	v1ess := new(V1ClientSession)
+	v1ess.SetRequestedFlags(NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(defaultV1ClientFlags()))
+
+	tests := []struct {
+		name    string
+		client  ClientSession
+		version int
+		allowed ResponseType
+		success bool
+	}{
+		{"NTLMv2", new(V2ClientSession), 2, 0, true},
+		{"NTLMv1", new(V1ClientSession), 1, 0, false},
+		{"NTLMv1", new(V1ClientSession), 1, ResponseNTLMv1, true},
+		{"NTLMv1 ESS", v1ess, 1, 0, true},
+		{"NTLMv2 only", new(V2ClientSession), 2, ResponseNTLMv2, true},
+	}
+
+	for _, test := range tests {
+		test.client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		server, _ := CreateServerSession(VersionAuto, ConnectionOrientedMode)
+		auto := server.(*AutoServerSession)
+		auto.SetUserInfo("User", "Password", "Domain", "")
+		auto.SetAllowedResponseTypes(test.allowed)
+
+		// The flags of the negotiate message decide if extended session security is used
+		test.client.SetMode(ConnectionOrientedMode)
+		nm, _ := test.client.GenerateNegotiateMessage()
+		auto.ProcessNegotiateMessage(nm)
+
+		err := runAutoHandshake(t, test.client, auto)
+		if !test.success {
+			if err != ErrResponseTypeNotAllowed {
+				t.Errorf("%s: expected response type error got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: could not authenticate: %s", test.name, err)
+			continue
+		}
+		if auto.Version() != test.version {
+			t.Errorf("%s: expected version %d got %d", test.name, test.version, auto.Version())
+		}
+
+		sealed, signature, err := test.client.Seal([]byte("Plaintext"))
+		if err != nil {
+			t.Fatalf("%s: could not seal message: %s", test.name, err)
+		}
+		plaintext, err := auto.Unseal(sealed, signature)
+		if err != nil || string(plaintext) != "Plaintext" {
+			t.Errorf("%s: server could not unseal client message: %s", test.name, err)
+		}
+	}
+}
+
+func TestAutoServerSessionWrongPassword(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Wrong", "Domain", "COMPUTER")
+	server := new(AutoServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	if err := runAutoHandshake(t, client, server); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestAutoServerSessionReuse(t *testing.T) {
+	server := new(AutoServerSession)
+	server.SetAllowAnonymous(true)
+	if server.Version() != 0 {
+		t.Errorf("Version should be 0 before authentication got %d", server.Version())
+	}
+
+	client := new(V2ClientSession)
+	client.SetAnonymous()
+	if err := runAutoHandshake(t, client, server); err != nil || !server.IsAnonymous() || server.Version() != 2 {
+		t.Fatalf("Could not authenticate the anonymous client: %v", err)
+	}
+
+	// Setting the credentials again clears the state of the anonymous client
+	server.SetUserInfo("User", "Password", "Domain", "")
+	if server.IsAnonymous() {
+		t.Error("Session should not be anonymous after SetUserInfo")
+	}
+
+	client = new(V2ClientSession)
+	client.SetUserInfo("User", "Wrong", "Domain", "COMPUTER")
+	if err := runAutoHandshake(t, client, server); err == nil || server.Version() != 0 {
+		t.Errorf("Rejected client should leave the version at 0 got %d: %v", server.Version(), err)
+	}
+}
+
+func TestAuthenticateMessageResponseType(t *testing.T) {
+	am := new(AuthenticateMessage)
+	am.UserName, _ = CreateStringPayload("User")
+	am.LmChallengeResponse, _ = CreateBytePayload(make([]byte, 24))
+	am.NtChallengeResponseFields, _ = CreateBytePayload(make([]byte, 0))
+	if responseType, _ := am.ResponseType(); responseType != ResponseLM {
+		t.Errorf("Expected LM response got %d", responseType)
+	}
+
+	am.NtChallengeResponseFields, _ = CreateBytePayload(make([]byte, 24))
+	if responseType, _ := am.ResponseType(); responseType != ResponseNTLMv1 {
+		t.Errorf("Expected NTLMv1 response got %d", responseType)
+	}
+
+	am.NegotiateFlags = NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(0)
+	if responseType, _ := am.ResponseType(); responseType != ResponseNTLMv1ESS {
+		t.Errorf("Expected NTLMv1 ESS response got %d", responseType)
+	}
+
+	am.NtChallengeResponseFields, _ = CreateBytePayload(make([]byte, 16))
+	if _, err := am.ResponseType(); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
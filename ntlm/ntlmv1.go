@@ -4,9 +4,6 @@ package ntlm
 
 import (
 	"bytes"
-	rc4P "crypto/rc4"
-	"errors"
-	"log"
 	"strings"
 )
 
@@ -25,6 +22,28 @@ func (n *V1Session) SetUserInfo(username string, password string, domain string,
 	n.password = password
 	n.userDomain = domain
 	n.workstation = workstation
+	n.ntHash = nil
+	n.lmHash = nil
+	n.anonymous = false
+}
+
+// SetUserHash sets the username, domain and workstation for the session together with the NT hash of the password
+// instead of the password itself. The LM hash is optional, without it the LM response is a copy of the NT response
+// and NTLMSSP_NEGOTIATE_LM_KEY can't be used. Both hashes must be 16 bytes, otherwise ErrInvalidHash is returned.
+func (n *V1Session) SetUserHash(username string, ntHash []byte, lmHash []byte, domain string, workstation string) error {
+	err := checkUserHash(ntHash, lmHash)
+	if err != nil {
+		return err
+	}
+
+	n.user = username
+	n.password = ""
+	n.userDomain = domain
+	n.workstation = workstation
+	n.ntHash = ntHash
+	n.lmHash = lmHash
+	n.anonymous = false
+	return nil
 }
 
 // GetUserInfo returns the username, password, domain and workstation for the session
@@ -41,6 +60,14 @@ func (n *V1Session) Version() int {
 }
 
 func (n *V1Session) fetchResponseKeys() (err error) {
+	// When the hashes of the user are known the password is not needed. Without an LM hash the LM response is a
+	// copy of the NT response.
+	if n.ntHash != nil {
+		n.responseKeyLM = n.lmHash
+		n.responseKeyNT = n.ntHash
+		return
+	}
+
 	n.responseKeyLM, err = lmowfv1(n.password)
 	if err != nil {
 		return err
@@ -65,7 +92,7 @@ func (n *V1Session) computeExpectedResponses() (err error) {
 		// response to the server challenge when NTLMv1 authentication is used.<30>
 		// <30> Section 3.1.1.1: The default value of this state variable is TRUE. Windows NT Server 4.0 SP3
 		// does not support providing NTLM instead of LM responses.
-		noLmResponseNtlmV1 := false
+		noLmResponseNtlmV1 := len(n.responseKeyLM) == 0
 		if noLmResponseNtlmV1 {
 			n.lmChallengeResponse = n.ntChallengeResponse
 		} else {
@@ -79,6 +106,26 @@ func (n *V1Session) computeExpectedResponses() (err error) {
 	return nil
 }
 
+// Computes the challenge responses, the session base key and the key exchange key from the credentials of the user
+func (n *V1Session) computeResponses() (err error) {
+	err = n.fetchResponseKeys()
+	if err != nil {
+		return err
+	}
+
+	err = n.computeExpectedResponses()
+	if err != nil {
+		return err
+	}
+
+	err = n.computeSessionBaseKey()
+	if err != nil {
+		return err
+	}
+
+	return n.computeKeyExchangeKey()
+}
+
 func (n *V1Session) computeSessionBaseKey() (err error) {
 	n.sessionBaseKey = md4(n.responseKeyNT)
 	return
@@ -88,6 +135,9 @@ func (n *V1Session) computeKeyExchangeKey() (err error) {
 	if NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags) {
 		n.keyExchangeKey = hmacMd5(n.sessionBaseKey, concat(n.serverChallenge, n.lmChallengeResponse[0:8]))
 	} else {
+		if (NTLMSSP_NEGOTIATE_LM_KEY.IsSet(n.NegotiateFlags) || NTLMSSP_REQUEST_NON_NT_SESSION_KEY.IsSet(n.NegotiateFlags)) && len(n.responseKeyLM) == 0 {
+			return newError(ErrNegotiationFailure, "The LM hash of the user is needed for the negotiated session key but is not available")
+		}
 		n.keyExchangeKey, err = kxKey(n.NegotiateFlags, n.sessionBaseKey, n.lmChallengeResponse, n.serverChallenge, n.responseKeyLM)
 	}
 	return
@@ -101,45 +151,112 @@ func (n *V1Session) calculateKeys(ntlmRevisionCurrent uint8) (err error) {
 	return
 }
 
-func (n *V1Session) Seal(message []byte) ([]byte, error) {
-	return nil, nil
+// Seal encrypts a message sent by the server and returns it together with its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V1ServerSession) Seal(message []byte) ([]byte, []byte, error) {
+	return n.serverSeal(message, nil)
 }
 
-func (n *V1Session) Sign(message []byte) ([]byte, error) {
-	return nil, nil
+// SealDatagram encrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V1ServerSession) SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error) {
+	return n.serverSeal(message, &sequenceNumber)
 }
 
-func ntlmV1Mac(message []byte, sequenceNumber int, handle *rc4P.Cipher, sealingKey, signingKey []byte, NegotiateFlags uint32) []byte {
-	// TODO: Need to keep track of the sequence number for connection oriented NTLM
-	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(NegotiateFlags) {
-		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
-	} else if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) {
-		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
-		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
-		handle, _ = rc4Init(sealingKey)
-	}
-	sig := mac(NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
-	return sig.Bytes()
+// Unseal decrypts a message sent by the client after checking its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V1ServerSession) Unseal(message, signature []byte) ([]byte, error) {
+	return n.clientUnseal(message, signature, nil)
 }
 
-func (n *V1ServerSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
-	mac := ntlmV1Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
-	return mac, nil
+// UnsealDatagram decrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V1ServerSession) UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.clientUnseal(message, signature, &sequenceNumber)
 }
 
-func (n *V1ClientSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
-	mac := ntlmV1Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
-	return mac, nil
+// Seal encrypts a message sent by the client and returns it together with its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V1ClientSession) Seal(message []byte) ([]byte, []byte, error) {
+	return n.clientSeal(message, nil)
 }
 
-func (n *V1ServerSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
-	mac := ntlmV1Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
-	return MacsEqual(mac, expectedMac), nil
+// SealDatagram encrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V1ClientSession) SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error) {
+	return n.clientSeal(message, &sequenceNumber)
 }
 
-func (n *V1ClientSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
-	mac := ntlmV1Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
-	return MacsEqual(mac, expectedMac), nil
+// Unseal decrypts a message sent by the server after checking its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V1ClientSession) Unseal(message, signature []byte) ([]byte, error) {
+	return n.serverUnseal(message, signature, nil)
+}
+
+// UnsealDatagram decrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V1ClientSession) UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.serverUnseal(message, signature, &sequenceNumber)
+}
+
+// Sign returns the detached NTLMSSP_MESSAGE_SIGNATURE of a message sent by the server
+func (n *V1ServerSession) Sign(message []byte) ([]byte, error) {
+	return n.serverSign(message, nil)
+}
+
+// SignDatagram signs a message of a connectionless session with the sequence number the application supplies
+func (n *V1ServerSession) SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.serverSign(message, &sequenceNumber)
+}
+
+// VerifySignature checks the NTLMSSP_MESSAGE_SIGNATURE of a message sent by the client. The error tells
+// if the version, the sequence number or the checksum of the signature is wrong.
+func (n *V1ServerSession) VerifySignature(message, signature []byte) error {
+	return n.clientVerifySignature(message, signature, nil)
+}
+
+// VerifyDatagramSignature checks the signature of a message of a connectionless session with the sequence
+// number the application supplies
+func (n *V1ServerSession) VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error {
+	return n.clientVerifySignature(message, signature, &sequenceNumber)
+}
+
+// Sign returns the detached NTLMSSP_MESSAGE_SIGNATURE of a message sent by the client
+func (n *V1ClientSession) Sign(message []byte) ([]byte, error) {
+	return n.clientSign(message, nil)
+}
+
+// SignDatagram signs a message of a connectionless session with the sequence number the application supplies
+func (n *V1ClientSession) SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.clientSign(message, &sequenceNumber)
+}
+
+// VerifySignature checks the NTLMSSP_MESSAGE_SIGNATURE of a message sent by the server. The error tells
+// if the version, the sequence number or the checksum of the signature is wrong.
+func (n *V1ClientSession) VerifySignature(message, signature []byte) error {
+	return n.serverVerifySignature(message, signature, nil)
+}
+
+// VerifyDatagramSignature checks the signature of a message of a connectionless session with the sequence
+// number the application supplies
+func (n *V1ClientSession) VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error {
+	return n.serverVerifySignature(message, signature, &sequenceNumber)
+}
+
+// Mac computes the signature of a message sent by the server with the sequence number the connection oriented
+// session keeps track of. Connectionless sessions use SignDatagram instead.
+func (n *V1ServerSession) Mac(message []byte) ([]byte, error) {
+	return n.serverMac(message)
+}
+
+// Mac computes the signature of a message sent by the client with the sequence number the connection oriented
+// session keeps track of. Connectionless sessions use SignDatagram instead.
+func (n *V1ClientSession) Mac(message []byte) ([]byte, error) {
+	return n.clientMac(message)
+}
+
+// VerifyMac checks the signature of a message sent by the client with the sequence number the connection
+// oriented session keeps track of. Connectionless sessions use VerifyDatagramSignature instead.
+func (n *V1ServerSession) VerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.clientVerifyMac(message, expectedMac)
+}
+
+// VerifyMac checks the signature of a message sent by the server with the sequence number the connection
+// oriented session keeps track of. Connectionless sessions use VerifyDatagramSignature instead.
+func (n *V1ClientSession) VerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.serverVerifyMac(message, expectedMac)
 }
 
 /**************
@@ -150,14 +267,55 @@ type V1ServerSession struct {
 	V1Session
 }
 
+// SetExtendedSessionSecurity controls if the server supports NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY (the NTLM2
+// session response). It is negotiated when the client asks for it.
+func (n *V1ServerSession) SetExtendedSessionSecurity(enabled bool) {
+	n.setCapability(NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY, enabled)
+}
+
+// SetTargetInfo controls if the generated challenge includes the TargetInfo fields. They are optional for NTLMv1.
+func (n *V1ServerSession) SetTargetInfo(enabled bool) {
+	n.setCapability(NTLMSSP_NEGOTIATE_TARGET_INFO, enabled)
+}
+
+func (n *V1ServerSession) setCapability(flag NegotiateFlag, enabled bool) {
+	capabilities := n.capabilities(defaultV1ServerFlags())
+	if enabled {
+		n.SetServerCapabilities(flag.Set(capabilities))
+	} else {
+		n.SetServerCapabilities(flag.Unset(capabilities))
+	}
+}
+
 func (n *V1ServerSession) ProcessNegotiateMessage(nm *NegotiateMessage) (err error) {
 	n.negotiateMessage = nm
 	return
 }
 
 func (n *V1ServerSession) GenerateChallengeMessage() (cm *ChallengeMessage, err error) {
-	// TODO: Generate this challenge message
-	return
+	flags, err := n.challengeFlags(defaultV1ServerFlags())
+	if err != nil {
+		return nil, err
+	}
+	return n.generateChallengeMessage(flags), nil
+}
+
+// The flags an NTLMv1 server supports unless SetServerCapabilities was used. Extended session security and the
+// TargetInfo fields are off by default.
+func defaultV1ServerFlags() uint32 {
+	flags := uint32(0)
+	flags = NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_VERSION.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_NTLM.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SIGN.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SEAL.Set(flags)
+	flags = NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = NTLM_NEGOTIATE_OEM.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_128.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_56.Set(flags)
+	return flags
 }
 
 func (n *V1ServerSession) SetServerChallenge(challenge []byte) {
@@ -170,89 +328,97 @@ func (n *V1ServerSession) GetSessionData() *SessionData {
 
 func (n *V1ServerSession) ProcessAuthenticateMessage(am *AuthenticateMessage) (err error) {
 	n.authenticateMessage = am
-	n.NegotiateFlags = am.NegotiateFlags
+	n.loopback = false
 	n.clientChallenge = am.ClientChallenge()
 	n.encryptedRandomSessionKey = am.EncryptedRandomSessionKey.Payload
 	// Ignore the values used in SetUserInfo and use these instead from the authenticate message
 	// They should always be correct (I hope)
-	n.user = am.UserName.String()
-	n.userDomain = am.DomainName.String()
-	log.Printf("(ProcessAuthenticateMessage)NTLM v1 User %s Domain %s", n.user, n.userDomain)
-
-	err = n.fetchResponseKeys()
+	n.user = n.payloadString(am.UserName)
+	n.userDomain = n.payloadString(am.DomainName)
+	n.log(LogInfo, "Processing NTLM v1 authenticate message", "user", n.identity(n.user), "domain", n.identity(n.userDomain))
+
+	n.NegotiateFlags, err = n.authenticateFlags(am)
+	if err == nil {
+		if am.isAnonymous() {
+			err = n.acceptAnonymous()
+		} else {
+			err = n.verifyResponses(am)
+		}
+	}
 	if err != nil {
+		n.log(LogInfo, "NTLM authentication failed", "user", n.identity(n.user), "domain", n.identity(n.userDomain), "status", ErrorStatus(err), "error", err)
 		return err
 	}
 
-	err = n.computeExpectedResponses()
+	// The MIC is not verified: NTLMv1 responses have no AvPairs in which the client could announce it, so a MIC
+	// that was removed could not be told apart from one that was never sent
+	n.mic = am.Mic
+
+	err = n.computeExportedSessionKey()
 	if err != nil {
 		return err
 	}
 
-	err = n.computeSessionBaseKey()
+	// The version is only sent when NTLMSSP_NEGOTIATE_VERSION is negotiated, all current clients use revision 15
+	ntlmRevision := NTLMSSP_REVISION_W2K3
+	if am.Version != nil {
+		ntlmRevision = am.Version.NTLMRevisionCurrent
+	}
+	err = n.calculateKeys(ntlmRevision)
 	if err != nil {
 		return err
 	}
 
-	err = n.computeKeyExchangeKey()
+	n.clientHandle, err = rc4Init(n.ClientSealingKey)
 	if err != nil {
 		return err
 	}
-
-	if !bytes.Equal(am.NtChallengeResponseFields.Payload, n.ntChallengeResponse) {
-		// There is a bug with the steps in MS-NLMP. In section 3.2.5.1.2 it says you should fall through
-		// to compare the lmChallengeResponse if the ntChallengeRepsonse fails, but with extended session security
-		// this would *always* pass because the lmChallengeResponse and expectedLmChallengeRepsonse will always
-		// be the same
-		if !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) || NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags) {
-			return errors.New("Could not authenticate")
-		}
-	}
-
-	n.mic = am.Mic
-	am.Mic = zeroBytes(16)
-
-	err = n.computeExportedSessionKey()
+	n.serverHandle, err = rc4Init(n.ServerSealingKey)
 	if err != nil {
 		return err
 	}
 
-	if am.Version == nil {
-		// UGH not entirely sure how this could possibly happen, going to put this in for now
-		// TODO investigate if this ever is really happening
-		am.Version = &VersionStruct{ProductMajorVersion: uint8(6), ProductMinorVersion: uint8(1), ProductBuild: uint16(7601), NTLMRevisionCurrent: uint8(15)}
-		log.Printf("Nil version in ntlmv1")
-	}
+	return nil
+}
+
+// Checks the challenge responses of the client against the credentials of the user and computes the key exchange key
+func (n *V1ServerSession) verifyResponses(am *AuthenticateMessage) (err error) {
+	n.anonymous = false
 
-	err = n.calculateKeys(am.Version.NTLMRevisionCurrent)
+	err = n.lookupCredentials()
 	if err != nil {
 		return err
 	}
 
-	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	err = n.computeResponses()
 	if err != nil {
 		return err
 	}
-	n.serverHandle, err = rc4Init(n.ServerSealingKey)
-	if err != nil {
-		return err
+
+	if !bytes.Equal(am.NtChallengeResponseFields.Payload, n.ntChallengeResponse) {
+		// There is a bug with the steps in MS-NLMP. In section 3.2.5.1.2 it says you should fall through
+		// to compare the lmChallengeResponse if the ntChallengeRepsonse fails, but with extended session security
+		// this would *always* pass because the lmChallengeResponse and expectedLmChallengeRepsonse will always
+		// be the same
+		if !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) || NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(n.NegotiateFlags) {
+			return ErrLogonFailure
+		}
 	}
 
-	return nil
+	return n.checkChannelBindings(nil)
 }
 
 func (n *V1ServerSession) computeExportedSessionKey() (err error) {
 	if NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(n.NegotiateFlags) {
+		if len(n.encryptedRandomSessionKey) != 16 {
+			return newError(ErrMalformedMessage, "Encrypted random session key must be 16 bytes")
+		}
 		n.exportedSessionKey, err = rc4K(n.keyExchangeKey, n.encryptedRandomSessionKey)
 		if err != nil {
 			return err
 		}
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.exportedSessionKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	} else {
 		n.exportedSessionKey = n.keyExchangeKey
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.keyExchangeKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	}
 	return nil
 }
@@ -266,7 +432,24 @@ type V1ClientSession struct {
 }
 
 func (n *V1ClientSession) GenerateNegotiateMessage() (nm *NegotiateMessage, err error) {
-	return nil, nil
+	return n.generateNegotiateMessage(defaultV1ClientFlags()), nil
+}
+
+// The flags sent in the NEGOTIATE_MESSAGE when the caller did not ask for a specific set
+func defaultV1ClientFlags() uint32 {
+	flags := uint32(0)
+	flags = NTLMSSP_NEGOTIATE_56.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_128.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_VERSION.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_NTLM.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SEAL.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SIGN.Set(flags)
+	flags = NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = NTLM_NEGOTIATE_OEM.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	return flags
 }
 
 func (n *V1ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err error) {
@@ -276,24 +459,13 @@ func (n *V1ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err err
 
 	n.NegotiateFlags = cm.NegotiateFlags
 
-	err = n.fetchResponseKeys()
-	if err != nil {
-		return err
-	}
-
-	err = n.computeExpectedResponses()
-	if err != nil {
-		return err
-	}
-
-	err = n.computeSessionBaseKey()
-	if err != nil {
-		return err
-	}
-
-	err = n.computeKeyExchangeKey()
-	if err != nil {
-		return err
+	if n.anonymous {
+		n.anonymousResponses()
+	} else {
+		err = n.computeResponses()
+		if err != nil {
+			return err
+		}
 	}
 
 	err = n.computeEncryptedSessionKey()
@@ -310,7 +482,7 @@ func (n *V1ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err err
 		return err
 	}
 
-	if len(n.ClientSigningKey) > 0 {
+	if len(n.ClientSealingKey) > 0 {
 		n.clientHandle, err = rc4Init(n.ClientSealingKey)
 		if err != nil {
 			return err
@@ -333,12 +505,14 @@ func (n *V1ClientSession) GenerateAuthenticateMessage() (am *AuthenticateMessage
 	am.MessageType = uint32(3)
 	am.LmChallengeResponse, _ = CreateBytePayload(n.lmChallengeResponse)
 	am.NtChallengeResponseFields, _ = CreateBytePayload(n.ntChallengeResponse)
-	am.DomainName, _ = CreateStringPayload(n.userDomain)
-	am.UserName, _ = CreateStringPayload(n.user)
-	am.Workstation, _ = CreateStringPayload(n.workstation)
+	am.DomainName = n.createStringPayload(n.userDomain, n.NegotiateFlags)
+	am.UserName = n.createStringPayload(n.user, n.NegotiateFlags)
+	am.Workstation = n.createStringPayload(n.workstation, n.NegotiateFlags)
 	am.EncryptedRandomSessionKey, _ = CreateBytePayload(n.encryptedRandomSessionKey)
 	am.NegotiateFlags = n.NegotiateFlags
-	am.Version = &VersionStruct{ProductMajorVersion: uint8(6), ProductMinorVersion: uint8(1), ProductBuild: uint16(7601), NTLMRevisionCurrent: uint8(15)}
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(n.NegotiateFlags) {
+		am.Version = n.localVersion()
+	}
 	return am, nil
 }
 
@@ -350,7 +524,8 @@ func (n *V1ClientSession) computeEncryptedSessionKey() (err error) {
 			return err
 		}
 	} else {
-		n.encryptedRandomSessionKey = n.keyExchangeKey
+		n.exportedSessionKey = n.keyExchangeKey
+		n.encryptedRandomSessionKey = make([]byte, 0)
 	}
 	return nil
 }
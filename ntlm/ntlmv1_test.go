@@ -140,7 +140,7 @@ func TestNtlmV1(t *testing.T) {
 	challengeMessageBytes, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef00000000000000002400240044000000060070170000000f53006500720076006500720002000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
 	challengeMessage, err := ParseChallengeMessage(challengeMessageBytes)
 	if err == nil {
-		challengeMessage.String()
+		_ = challengeMessage.String()
 	} else {
 		t.Errorf("Could not parse challenge message: %s", err)
 	}
@@ -157,7 +157,7 @@ func TestNtlmV1(t *testing.T) {
 	authenticateMessageBytes, err := hex.DecodeString("4e544c4d5353500003000000180018006c00000018001800840000000c000c00480000000800080054000000100010005c000000100010009c000000358280e20501280a0000000f44006f006d00610069006e00550073006500720043004f004d005000550054004500520098def7b87f88aa5dafe2df779688a172def11c7d5ccdef1367c43011f30298a2ad35ece64f16331c44bdbed927841f94518822b1b3f350c8958682ecbb3e3cb7")
 	authenticateMessage, err := ParseAuthenticateMessage(authenticateMessageBytes, 1)
 	if err == nil {
-		authenticateMessage.String()
+		_ = authenticateMessage.String()
 	} else {
 		t.Errorf("Could not parse authenticate message: %s", err)
 	}
@@ -206,7 +206,7 @@ func TestNTLMv1WithClientChallenge(t *testing.T) {
 	challengeMessageBytes, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef00000000000000002400240044000000060070170000000f53006500720076006500720002000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
 	challengeMessage, err := ParseChallengeMessage(challengeMessageBytes)
 	if err == nil {
-		challengeMessage.String()
+		_ = challengeMessage.String()
 	} else {
 		t.Errorf("Could not parse challenge message: %s", err)
 	}
@@ -225,7 +225,7 @@ func TestNTLMv1WithClientChallenge(t *testing.T) {
 	authenticateMessageBytes, _ := hex.DecodeString("4e544c4d5353500003000000180018006c00000018001800840000000c000c00480000000800080054000000100010005c000000000000009c000000358208820501280a0000000f44006f006d00610069006e00550073006500720043004f004d0050005500540045005200aaaaaaaaaaaaaaaa000000000000000000000000000000007537f803ae367128ca458204bde7caf81e97ed2683267232")
 	authenticateMessage, err := ParseAuthenticateMessage(authenticateMessageBytes, 1)
 	if err == nil {
-		authenticateMessage.String()
+		_ = authenticateMessage.String()
 	} else {
 		t.Errorf("Could not parse authenticate message: %s", err)
 	}
@@ -238,3 +238,66 @@ func TestNTLMv1WithClientChallenge(t *testing.T) {
 	checkV1Value(t, "SealKey", server.ClientSealingKey, "04dd7f014d8504d265a25cc86a3a7c06", nil)
 	checkV1Value(t, "SignKey", server.ClientSigningKey, "60e799be5c72fc92922ae8ebe961fb8d", nil)
 }
+
+func TestNtlmV1GeneratedChallenge(t *testing.T) {
+	for _, ess := range []bool{false, true} {
+		for _, targetInfo := range []bool{false, true} {
+			server := new(V1ServerSession)
+			server.SetUserInfo("User", "Password", "Domain", "")
+			server.SetExtendedSessionSecurity(ess)
+			server.SetTargetInfo(targetInfo)
+
+			challenge, err := server.GenerateChallengeMessage()
+			if err != nil || challenge == nil {
+				t.Fatalf("Could not generate challenge message: %s", err)
+			}
+			if NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(challenge.NegotiateFlags) != ess {
+				t.Errorf("Extended session security flag should be %v", ess)
+			}
+			if NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(challenge.NegotiateFlags) != targetInfo || (challenge.TargetInfo != nil) != targetInfo {
+				t.Errorf("Target info should be present: %v", targetInfo)
+			}
+
+			challenge, err = ParseChallengeMessage(challenge.Bytes())
+			if err != nil {
+				t.Fatalf("Could not parse generated challenge message: %s", err)
+			}
+			if challenge.Version == nil {
+				t.Error("Version should be present in the generated challenge message")
+			}
+
+			client := new(V1ClientSession)
+			client.SetUserInfo("User", "Password", "Domain", "")
+			err = client.ProcessChallengeMessage(challenge)
+			if err != nil {
+				t.Fatalf("Could not process challenge message: %s", err)
+			}
+
+			am, _ := client.GenerateAuthenticateMessage()
+			am, err = ParseAuthenticateMessage(am.Bytes(), 1)
+			if err != nil {
+				t.Fatalf("Could not parse authenticate message: %s", err)
+			}
+
+			err = server.ProcessAuthenticateMessage(am)
+			if err != nil {
+				t.Errorf("Could not authenticate with ESS %v and target info %v: %s", ess, targetInfo, err)
+			}
+			checkV1Value(t, "client seal key", server.ClientSealingKey, hex.EncodeToString(client.ClientSealingKey), nil)
+
+			sealed, signature, err := client.SealDatagram([]byte("Plaintext"), 0)
+			if err != nil {
+				t.Fatalf("Could not seal message: %s", err)
+			}
+			plaintext, err := server.UnsealDatagram(sealed, signature, 0)
+			if err != nil || string(plaintext) != "Plaintext" {
+				t.Errorf("Server could not unseal client message: %s", err)
+			}
+			sealed, signature, _ = server.SealDatagram([]byte("Plaintext"), 0)
+			plaintext, err = client.UnsealDatagram(sealed, signature, 0)
+			if err != nil || string(plaintext) != "Plaintext" {
+				t.Errorf("Client could not unseal server message: %s", err)
+			}
+		}
+	}
+}
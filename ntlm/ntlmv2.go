@@ -6,8 +6,6 @@ import (
 	"bytes"
 	rc4P "crypto/rc4"
 	"encoding/binary"
-	"errors"
-	"log"
 	"strings"
 	"time"
 )
@@ -27,6 +25,28 @@ func (n *V2Session) SetUserInfo(username string, password string, domain string,
 	n.password = password
 	n.userDomain = domain
 	n.workstation = workstation
+	n.ntHash = nil
+	n.lmHash = nil
+	n.anonymous = false
+}
+
+// SetUserHash sets the username, domain and workstation for the session together with the NT hash of the password
+// instead of the password itself. NTLMv2 derives all its keys from the NT hash so the LM hash is not used. Both
+// hashes must be 16 bytes, otherwise ErrInvalidHash is returned.
+func (n *V2Session) SetUserHash(username string, ntHash []byte, lmHash []byte, domain string, workstation string) error {
+	err := checkUserHash(ntHash, lmHash)
+	if err != nil {
+		return err
+	}
+
+	n.user = username
+	n.password = ""
+	n.userDomain = domain
+	n.workstation = workstation
+	n.ntHash = ntHash
+	n.lmHash = lmHash
+	n.anonymous = false
+	return nil
 }
 
 // GetUserInfo returns the username, password, and domain for the session
@@ -45,8 +65,12 @@ func (n *V2Session) Version() int {
 }
 
 func (n *V2Session) fetchResponseKeys() (err error) {
-	// Usually at this point we'd go out to Active Directory and get these keys
-	// Here we are assuming we have the information locally
+	// The NT hash is set by SetUserHash or comes from the CredentialProvider of a server, otherwise the password is used
+	if n.ntHash != nil {
+		n.responseKeyNT = ntowfv2FromHash(n.user, n.ntHash, n.userDomain)
+		n.responseKeyLM = n.responseKeyNT
+		return
+	}
 	n.responseKeyLM = lmowfv2(n.user, n.password, n.userDomain)
 	n.responseKeyNT = ntowfv2(n.user, n.password, n.userDomain)
 	return
@@ -81,60 +105,126 @@ func (n *V2Session) calculateKeys(ntlmRevisionCurrent uint8) (err error) {
 	return
 }
 
-func (n *V2Session) Seal(message []byte) ([]byte, error) {
-	return nil, nil
-}
-
-func (n *V2Session) Sign(message []byte) ([]byte, error) {
-	return nil, nil
-}
-
 // Mildly ghetto that we expose this
 func NtlmVCommonMac(message []byte, sequenceNumber int, sealingKey, signingKey []byte, NegotiateFlags uint32) []byte {
-	var handle *rc4P.Cipher
-	// TODO: Need to keep track of the sequence number for connection oriented NTLM
-	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(NegotiateFlags) {
-		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
-	} else if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) {
-		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
-		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
-		handle, _ = rc4Init(sealingKey)
-	}
+	handle := connectionlessHandle(nil, sealingKey, sequenceNumber, NegotiateFlags)
 	sig := mac(NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
 	return sig.Bytes()
 }
 
+// NtlmV2Mac computes the signature of a message in connectionless mode
 func NtlmV2Mac(message []byte, sequenceNumber int, handle *rc4P.Cipher, sealingKey, signingKey []byte, NegotiateFlags uint32) []byte {
-	// TODO: Need to keep track of the sequence number for connection oriented NTLM
-	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(NegotiateFlags) {
-		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
-	} else if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(NegotiateFlags) {
-		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
-		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
-		handle, _ = rc4Init(sealingKey)
-	}
+	handle = connectionlessHandle(handle, sealingKey, sequenceNumber, NegotiateFlags)
 	sig := mac(NegotiateFlags, handle, signingKey, uint32(sequenceNumber), message)
 	return sig.Bytes()
 }
 
-func (n *V2ServerSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
-	mac := NtlmV2Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
-	return mac, nil
+// Seal encrypts a message sent by the server and returns it together with its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V2ServerSession) Seal(message []byte) ([]byte, []byte, error) {
+	return n.serverSeal(message, nil)
+}
+
+// SealDatagram encrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V2ServerSession) SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error) {
+	return n.serverSeal(message, &sequenceNumber)
+}
+
+// Unseal decrypts a message sent by the client after checking its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V2ServerSession) Unseal(message, signature []byte) ([]byte, error) {
+	return n.clientUnseal(message, signature, nil)
+}
+
+// UnsealDatagram decrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V2ServerSession) UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.clientUnseal(message, signature, &sequenceNumber)
+}
+
+// Seal encrypts a message sent by the client and returns it together with its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V2ClientSession) Seal(message []byte) ([]byte, []byte, error) {
+	return n.clientSeal(message, nil)
 }
 
-func (n *V2ServerSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
-	mac := NtlmV2Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
-	return MacsEqual(mac, expectedMac), nil
+// SealDatagram encrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V2ClientSession) SealDatagram(message []byte, sequenceNumber uint32) ([]byte, []byte, error) {
+	return n.clientSeal(message, &sequenceNumber)
 }
 
-func (n *V2ClientSession) Mac(message []byte, sequenceNumber int) ([]byte, error) {
-	mac := NtlmV2Mac(message, sequenceNumber, n.clientHandle, n.ClientSealingKey, n.ClientSigningKey, n.NegotiateFlags)
-	return mac, nil
+// Unseal decrypts a message sent by the server after checking its NTLMSSP_MESSAGE_SIGNATURE
+func (n *V2ClientSession) Unseal(message, signature []byte) ([]byte, error) {
+	return n.serverUnseal(message, signature, nil)
 }
 
-func (n *V2ClientSession) VerifyMac(message, expectedMac []byte, sequenceNumber int) (bool, error) {
-	mac := NtlmV2Mac(message, sequenceNumber, n.serverHandle, n.ServerSealingKey, n.ServerSigningKey, n.NegotiateFlags)
-	return MacsEqual(mac, expectedMac), nil
+// UnsealDatagram decrypts a message of a connectionless session with the sequence number the application supplies
+func (n *V2ClientSession) UnsealDatagram(message, signature []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.serverUnseal(message, signature, &sequenceNumber)
+}
+
+// Sign returns the detached NTLMSSP_MESSAGE_SIGNATURE of a message sent by the server
+func (n *V2ServerSession) Sign(message []byte) ([]byte, error) {
+	return n.serverSign(message, nil)
+}
+
+// SignDatagram signs a message of a connectionless session with the sequence number the application supplies
+func (n *V2ServerSession) SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.serverSign(message, &sequenceNumber)
+}
+
+// VerifySignature checks the NTLMSSP_MESSAGE_SIGNATURE of a message sent by the client. The error tells
+// if the version, the sequence number or the checksum of the signature is wrong.
+func (n *V2ServerSession) VerifySignature(message, signature []byte) error {
+	return n.clientVerifySignature(message, signature, nil)
+}
+
+// VerifyDatagramSignature checks the signature of a message of a connectionless session with the sequence
+// number the application supplies
+func (n *V2ServerSession) VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error {
+	return n.clientVerifySignature(message, signature, &sequenceNumber)
+}
+
+// Sign returns the detached NTLMSSP_MESSAGE_SIGNATURE of a message sent by the client
+func (n *V2ClientSession) Sign(message []byte) ([]byte, error) {
+	return n.clientSign(message, nil)
+}
+
+// SignDatagram signs a message of a connectionless session with the sequence number the application supplies
+func (n *V2ClientSession) SignDatagram(message []byte, sequenceNumber uint32) ([]byte, error) {
+	return n.clientSign(message, &sequenceNumber)
+}
+
+// VerifySignature checks the NTLMSSP_MESSAGE_SIGNATURE of a message sent by the server. The error tells
+// if the version, the sequence number or the checksum of the signature is wrong.
+func (n *V2ClientSession) VerifySignature(message, signature []byte) error {
+	return n.serverVerifySignature(message, signature, nil)
+}
+
+// VerifyDatagramSignature checks the signature of a message of a connectionless session with the sequence
+// number the application supplies
+func (n *V2ClientSession) VerifyDatagramSignature(message, signature []byte, sequenceNumber uint32) error {
+	return n.serverVerifySignature(message, signature, &sequenceNumber)
+}
+
+// Mac computes the signature of a message sent by the server with the sequence number the connection oriented
+// session keeps track of. Connectionless sessions use SignDatagram instead.
+func (n *V2ServerSession) Mac(message []byte) ([]byte, error) {
+	return n.serverMac(message)
+}
+
+// VerifyMac checks the signature of a message sent by the client with the sequence number the connection
+// oriented session keeps track of. Connectionless sessions use VerifyDatagramSignature instead.
+func (n *V2ServerSession) VerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.clientVerifyMac(message, expectedMac)
+}
+
+// Mac computes the signature of a message sent by the client with the sequence number the connection oriented
+// session keeps track of. Connectionless sessions use SignDatagram instead.
+func (n *V2ClientSession) Mac(message []byte) ([]byte, error) {
+	return n.clientMac(message)
+}
+
+// VerifyMac checks the signature of a message sent by the server with the sequence number the connection
+// oriented session keeps track of. Connectionless sessions use VerifyDatagramSignature instead.
+func (n *V2ClientSession) VerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.serverVerifyMac(message, expectedMac)
 }
 
 /**************
@@ -155,11 +245,15 @@ func (n *V2ServerSession) ProcessNegotiateMessage(nm *NegotiateMessage) (err err
 }
 
 func (n *V2ServerSession) GenerateChallengeMessage() (cm *ChallengeMessage, err error) {
-	cm = new(ChallengeMessage)
-	cm.Signature = []byte("NTLMSSP\x00")
-	cm.MessageType = uint32(2)
-	cm.TargetName, _ = CreateBytePayload(make([]byte, 0))
+	flags, err := n.challengeFlags(defaultV2ServerFlags())
+	if err != nil {
+		return nil, err
+	}
+	return n.generateChallengeMessage(flags), nil
+}
 
+// The flags an NTLMv2 server supports unless SetServerCapabilities was used
+func defaultV2ServerFlags() uint32 {
 	flags := uint32(0)
 	flags = NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
 	flags = NTLMSSP_NEGOTIATE_VERSION.Set(flags)
@@ -168,114 +262,207 @@ func (n *V2ServerSession) GenerateChallengeMessage() (cm *ChallengeMessage, err
 	flags = NTLMSSP_NEGOTIATE_IDENTIFY.Set(flags)
 	flags = NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
 	flags = NTLMSSP_NEGOTIATE_NTLM.Set(flags)
-	flags = NTLMSSP_NEGOTIATE_DATAGRAM.Set(flags)
 	flags = NTLMSSP_NEGOTIATE_SIGN.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SEAL.Set(flags)
 	flags = NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = NTLM_NEGOTIATE_OEM.Set(flags)
 	flags = NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
 	flags = NTLMSSP_NEGOTIATE_128.Set(flags)
-
-	cm.NegotiateFlags = flags
-
-	n.serverChallenge = randomBytes(8)
-	cm.ServerChallenge = n.serverChallenge
-	cm.Reserved = make([]byte, 8)
-
-	// Create the AvPairs we need
-	pairs := new(AvPairs)
-	pairs.AddAvPair(MsvAvNbDomainName, utf16FromString("SEMATEXT"))
-	pairs.AddAvPair(MsvAvNbComputerName, utf16FromString("SYNTHETICS-HTTP-AGENT"))
-	pairs.AddAvPair(MsvAvDnsDomainName, utf16FromString("sematext.com"))
-	pairs.AddAvPair(MsvAvDnsComputerName, utf16FromString("synthetics-http-agent.sematext.com"))
-	pairs.AddAvPair(MsvAvDnsTreeName, utf16FromString("Sematext.com"))
-	pairs.AddAvPair(MsvAvEOL, make([]byte, 0))
-	cm.TargetInfo = pairs
-	cm.TargetInfoPayloadStruct, _ = CreateBytePayload(pairs.Bytes())
-
-	cm.Version = &VersionStruct{ProductMajorVersion: uint8(6), ProductMinorVersion: uint8(1), ProductBuild: uint16(7601), NTLMRevisionCurrent: uint8(15)}
-	return cm, nil
+	flags = NTLMSSP_NEGOTIATE_56.Set(flags)
+	return flags
 }
 
 func (n *V2ServerSession) ProcessAuthenticateMessage(am *AuthenticateMessage) (err error) {
 	n.authenticateMessage = am
-	n.NegotiateFlags = am.NegotiateFlags
+	n.loopback = false
 	n.clientChallenge = am.ClientChallenge()
 	n.encryptedRandomSessionKey = am.EncryptedRandomSessionKey.Payload
 	// Ignore the values used in SetUserInfo and use these instead from the authenticate message
 	// They should always be correct (I hope)
-	n.user = am.UserName.String()
-	n.userDomain = am.DomainName.String()
-	n.workstation = am.Workstation.String()
-	log.Printf("(ProcessAuthenticateMessage)NTLM v2 User %s Domain %s Workstation %s", n.user, n.userDomain, n.workstation)
+	n.user = n.payloadString(am.UserName)
+	n.userDomain = n.payloadString(am.DomainName)
+	n.workstation = n.payloadString(am.Workstation)
+	n.log(LogInfo, "Processing NTLM v2 authenticate message", "user", n.identity(n.user), "domain", n.identity(n.userDomain), "workstation", n.identity(n.workstation))
 
-	err = n.fetchResponseKeys()
+	pairs, err := n.authenticate(am)
 	if err != nil {
+		n.log(LogInfo, "NTLM authentication failed", "user", n.identity(n.user), "domain", n.identity(n.userDomain), "status", ErrorStatus(err), "error", err)
 		return err
 	}
 
-	timestamp := am.NtlmV2Response.NtlmV2ClientChallenge.TimeStamp
-	avPairsBytes := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.Bytes()
+	// The version is only sent when NTLMSSP_NEGOTIATE_VERSION is negotiated, all current clients use revision 15
+	ntlmRevision := NTLMSSP_REVISION_W2K3
+	if am.Version != nil {
+		ntlmRevision = am.Version.NTLMRevisionCurrent
+	}
+	err = n.calculateKeys(ntlmRevision)
+	if err != nil {
+		return err
+	}
 
-	err = n.computeExpectedResponses(timestamp, avPairsBytes)
+	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	if err != nil {
+		return err
+	}
+	n.serverHandle, err = rc4Init(n.ServerSealingKey)
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Equal(am.NtChallengeResponseFields.Payload, n.ntChallengeResponse) {
-		if !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) {
-			return errors.New("Could not authenticate")
-		}
+	// Only a message that was accepted as a whole can mark the session as a loopback
+	n.checkLoopback(pairs)
+	return nil
+}
+
+// Checks the responses and the MIC of the AUTHENTICATE_MESSAGE and returns the AvPairs that are covered by the
+// NTProofStr, or nil when there are none. The response is only remembered in the replay cache once the whole message
+// was accepted.
+func (n *V2ServerSession) authenticate(am *AuthenticateMessage) (pairs *AvPairs, err error) {
+	n.NegotiateFlags, err = n.authenticateFlags(am)
+	if err != nil {
+		return nil, err
 	}
 
-	err = n.computeKeyExchangeKey()
+	if am.isAnonymous() {
+		err = n.acceptAnonymous()
+	} else {
+		pairs, err = n.verifyResponses(am)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	n.mic = am.Mic
-	am.Mic = zeroBytes(16)
 
 	err = n.computeExportedSessionKey()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = n.verifyMic(am)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.anonymous {
+		return nil, nil
+	}
+	err = n.rememberResponse(am.NtlmV2Response.NtlmV2ClientChallenge)
+	if err != nil {
+		return nil, err
 	}
+	return pairs, nil
+}
 
-	if am.Version == nil {
-		// UGH not entirely sure how this could possibly happen, going to put this in for now
-		// TODO investigate if this ever is really happening
-		am.Version = &VersionStruct{ProductMajorVersion: uint8(6), ProductMinorVersion: uint8(1), ProductBuild: uint16(7601), NTLMRevisionCurrent: uint8(15)}
+// Checks the challenge responses of the client against the credentials of the user and computes the key exchange key.
+// The AvPairs of the NTLMv2 response are returned when the NTProofStr matched, which means they were not changed.
+func (n *V2ServerSession) verifyResponses(am *AuthenticateMessage) (pairs *AvPairs, err error) {
+	n.anonymous = false
 
-		log.Printf("Nil version in ntlmv2")
+	if am.NtlmV2Response == nil {
+		return nil, newError(ErrMalformedMessage, "Authenticate message does not contain an NTLMv2 response")
 	}
 
-	err = n.calculateKeys(am.Version.NTLMRevisionCurrent)
+	err = n.lookupCredentials()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	n.clientHandle, err = rc4Init(n.ClientSealingKey)
+	err = n.fetchResponseKeys()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	n.serverHandle, err = rc4Init(n.ServerSealingKey)
+
+	timestamp := am.NtlmV2Response.NtlmV2ClientChallenge.TimeStamp
+	avPairsBytes := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.Bytes()
+
+	err = n.computeExpectedResponses(timestamp, avPairsBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if !bytes.Equal(am.NtChallengeResponseFields.Payload, n.ntChallengeResponse) {
+		if !bytes.Equal(am.LmChallengeResponse.Payload, n.lmChallengeResponse) {
+			return nil, ErrLogonFailure
+		}
+		// The LMv2 response only covers the server and client challenges, not the AvPairs of the NTLMv2 response,
+		// which could have been changed. A client that is only authenticated by it is refused when the server
+		// relies on the AvPairs, and the AvPairs are not used for anything else.
+		if n.checksAvPairs() {
+			return nil, newError(ErrLogonFailure, "LMv2 response is not accepted when the AvPairs of the NTLMv2 response are checked")
+		}
+		return nil, n.computeKeyExchangeKey()
+	}
+
+	// The NTProofStr covers the AvPairs, so from here on they can be relied on
+	pairs = am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs
+	err = n.checkChannelBindings(pairs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.checkFreshness(am.NtlmV2Response.NtlmV2ClientChallenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return pairs, n.computeKeyExchangeKey()
+}
+
+// The AvPairs are checked for the channel bindings and the freshness of the response when these are configured, and
+// for the MIC whenever the server knows the CHALLENGE_MESSAGE it sent and can verify it
+func (n *V2ServerSession) checksAvPairs() bool {
+	config := n.config()
+	return n.channelBindingPolicy != ChannelBindingOff || config.MaxClockSkew > 0 || config.ReplayCache != nil ||
+		n.challengeMessage != nil || config.RequireMicVerification
 }
 
 func (n *V2ServerSession) computeExportedSessionKey() (err error) {
 	if NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(n.NegotiateFlags) {
+		if len(n.encryptedRandomSessionKey) != 16 {
+			return newError(ErrMalformedMessage, "Encrypted random session key must be 16 bytes")
+		}
 		n.exportedSessionKey, err = rc4K(n.keyExchangeKey, n.encryptedRandomSessionKey)
 		if err != nil {
 			return err
 		}
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.exportedSessionKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
 	} else {
 		n.exportedSessionKey = n.keyExchangeKey
-		// TODO: Calculate mic correctly. This calculation is not producing the right results now
-		// n.calculatedMic = HmacMd5(n.keyExchangeKey, concat(n.challengeMessage.Payload, n.authenticateMessage.Bytes))
+	}
+	return nil
+}
+
+// The client indicates that it sent a MIC with the 0x2 bit of MsvAvFlags in the NTLMv2_CLIENT_CHALLENGE. When the
+// NTProofStr matched it covers the AvPairs, so the bit can't be cleared and a MIC that is missing or wrong can only
+// be the result of tampering with the messages. The LMv2 response does not cover the AvPairs, which is why
+// verifyResponses refuses it whenever the server knows the CHALLENGE_MESSAGE and can verify a MIC. A server that
+// does not know the CHALLENGE_MESSAGE can only verify the MIC once it is restored with SetChallengeMessage.
+func (n *V2ServerSession) verifyMic(am *AuthenticateMessage) error {
+	// Anonymous clients have no NTLMv2 response to announce a MIC in
+	if am.NtlmV2Response == nil {
+		return nil
+	}
+
+	if !AvFlagMicProvided.IsSet(am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.Flags()) {
+		return nil
+	}
+
+	if len(am.Mic) != 16 {
+		return newError(ErrMicMismatch, "Authenticate message is missing the MIC")
+	}
+
+	// A session that only had the server challenge set does not know the CHALLENGE_MESSAGE that was sent, so
+	// there is nothing to verify the MIC against
+	if n.challengeMessage == nil {
+		if n.config().RequireMicVerification {
+			return newError(ErrMicMismatch, "MIC can not be verified without the CHALLENGE_MESSAGE that was sent")
+		}
+		n.log(LogDebug, "MIC is not verified because the CHALLENGE_MESSAGE is not known")
+		return nil
+	}
+
+	if !hmacEqual(n.calculateMic(am.bytesWithoutMic()), am.Mic) {
+		return ErrMicMismatch
 	}
 	return nil
 }
@@ -286,10 +473,30 @@ func (n *V2ServerSession) computeExportedSessionKey() (err error) {
 
 type V2ClientSession struct {
 	V2Session
+	// Set when the server sent TargetInfo, in that case the AUTHENTICATE_MESSAGE carries a MIC
+	sendMic bool
 }
 
 func (n *V2ClientSession) GenerateNegotiateMessage() (nm *NegotiateMessage, err error) {
-	return nil, nil
+	return n.generateNegotiateMessage(defaultV2ClientFlags()), nil
+}
+
+// The flags sent in the NEGOTIATE_MESSAGE when the caller did not ask for a specific set
+func defaultV2ClientFlags() uint32 {
+	flags := uint32(0)
+	flags = NTLMSSP_NEGOTIATE_56.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_KEY_EXCH.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_128.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_VERSION.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_NTLM.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SEAL.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_SIGN.Set(flags)
+	flags = NTLMSSP_REQUEST_TARGET.Set(flags)
+	flags = NTLM_NEGOTIATE_OEM.Set(flags)
+	flags = NTLMSSP_NEGOTIATE_UNICODE.Set(flags)
+	return flags
 }
 
 func (n *V2ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err error) {
@@ -299,24 +506,14 @@ func (n *V2ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err err
 
 	n.NegotiateFlags = cm.NegotiateFlags
 
-	err = n.fetchResponseKeys()
-	if err != nil {
-		return err
-	}
-
-	var payload []byte
-	if NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(cm.NegotiateFlags) {
-		payload = cm.TargetInfoPayloadStruct.Payload
-	}
-	timestamp := timeToWindowsFileTime(time.Now())
-	err = n.computeExpectedResponses(timestamp, payload)
-	if err != nil {
-		return err
-	}
-
-	err = n.computeKeyExchangeKey()
-	if err != nil {
-		return err
+	n.sendMic = false
+	if n.anonymous {
+		n.anonymousResponses()
+	} else {
+		err = n.computeResponses(cm)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = n.computeEncryptedSessionKey()
@@ -334,7 +531,7 @@ func (n *V2ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err err
 		return err
 	}
 
-	if len(n.ClientSigningKey) > 0 {
+	if len(n.ClientSealingKey) > 0 {
 		n.clientHandle, err = rc4Init(n.ClientSealingKey)
 		if err != nil {
 			return err
@@ -351,22 +548,91 @@ func (n *V2ClientSession) ProcessChallengeMessage(cm *ChallengeMessage) (err err
 	return nil
 }
 
+// Computes the challenge responses and the key exchange key from the credentials of the user
+func (n *V2ClientSession) computeResponses(cm *ChallengeMessage) (err error) {
+	err = n.fetchResponseKeys()
+	if err != nil {
+		return err
+	}
+
+	var payload, serverTimestamp []byte
+	if NTLMSSP_NEGOTIATE_TARGET_INFO.IsSet(cm.NegotiateFlags) {
+		targetInfo := cm.TargetInfo
+		if targetInfo == nil {
+			targetInfo, err = ReadAvPairs(cm.TargetInfoPayloadStruct.Payload)
+			if err != nil {
+				return err
+			}
+		}
+		payload = n.clientAvPairs(targetInfo).Bytes()
+		serverTimestamp = targetInfo.ByteValue(MsvAvTimestamp)
+		n.sendMic = true
+	}
+
+	// MS-NLMP 3.1.5.1.2: when the server sends its time the client uses it in the response and does not send
+	// an LMv2 response, the LmChallengeResponse is then Z(24)
+	timestamp := timeToWindowsFileTime(time.Now())
+	if len(serverTimestamp) == 8 {
+		timestamp = serverTimestamp
+	}
+	err = n.computeExpectedResponses(timestamp, payload)
+	if err != nil {
+		return err
+	}
+	if len(serverTimestamp) == 8 {
+		n.lmChallengeResponse = zeroBytes(24)
+	}
+
+	return n.computeKeyExchangeKey()
+}
+
 func (n *V2ClientSession) GenerateAuthenticateMessage() (am *AuthenticateMessage, err error) {
 	am = new(AuthenticateMessage)
 	am.Signature = []byte("NTLMSSP\x00")
 	am.MessageType = uint32(3)
 	am.LmChallengeResponse, _ = CreateBytePayload(n.lmChallengeResponse)
 	am.NtChallengeResponseFields, _ = CreateBytePayload(n.ntChallengeResponse)
-	am.DomainName, _ = CreateStringPayload(n.userDomain)
-	am.UserName, _ = CreateStringPayload(n.user)
-	am.Workstation, _ = CreateStringPayload(n.workstation)
+	am.DomainName = n.createStringPayload(n.userDomain, n.NegotiateFlags)
+	am.UserName = n.createStringPayload(n.user, n.NegotiateFlags)
+	am.Workstation = n.createStringPayload(n.workstation, n.NegotiateFlags)
 	am.EncryptedRandomSessionKey, _ = CreateBytePayload(n.encryptedRandomSessionKey)
 	am.NegotiateFlags = n.NegotiateFlags
 	am.Mic = make([]byte, 16)
-	am.Version = &VersionStruct{ProductMajorVersion: uint8(6), ProductMinorVersion: uint8(1), ProductBuild: uint16(7601), NTLMRevisionCurrent: 0x0F}
+	if NTLMSSP_NEGOTIATE_VERSION.IsSet(n.NegotiateFlags) {
+		am.Version = n.localVersion()
+	}
+
+	if n.sendMic {
+		am.Mic = n.calculateMic(am.Bytes())
+		n.mic = am.Mic
+	}
 	return am, nil
 }
 
+// Builds the AvPairs the client returns in the NTLMv2_CLIENT_CHALLENGE. These are the server's TargetInfo
+// with the MsvAvFlags bit set that tells the server the AUTHENTICATE_MESSAGE carries a MIC and, when the client has
+// them, the hash of the channel bindings.
+func (n *V2ClientSession) clientAvPairs(targetInfo *AvPairs) *AvPairs {
+	pairs := new(AvPairs)
+	for _, pair := range targetInfo.List {
+		switch pair.AvId {
+		case MsvAvEOL, MsvAvFlags, MsvAvSingleHost, MsvChannelBindings:
+		default:
+			pairs.AddAvPair(pair.AvId, pair.Value)
+		}
+	}
+
+	pairs.SetFlags(AvFlagMicProvided.Set(targetInfo.Flags()))
+	if n.singleHostData != nil {
+		pairs.SetSingleHost(n.singleHostData)
+	}
+	if n.channelBindings != nil {
+		pairs.AddAvPair(MsvChannelBindings, n.channelBindings.Hash())
+	}
+	pairs.AddAvPair(MsvAvEOL, make([]byte, 0))
+	return pairs
+}
+
 func (n *V2ClientSession) computeEncryptedSessionKey() (err error) {
 	if NTLMSSP_NEGOTIATE_KEY_EXCH.IsSet(n.NegotiateFlags) {
 		n.exportedSessionKey = randomBytes(16)
@@ -375,7 +641,8 @@ func (n *V2ClientSession) computeEncryptedSessionKey() (err error) {
 			return err
 		}
 	} else {
-		n.encryptedRandomSessionKey = n.keyExchangeKey
+		n.exportedSessionKey = n.keyExchangeKey
+		n.encryptedRandomSessionKey = make([]byte, 0)
 	}
 	return nil
 }
@@ -386,8 +653,13 @@ func (n *V2ClientSession) computeEncryptedSessionKey() (err error) {
 
 // Define ntowfv2(Passwd, User, UserDom) as
 func ntowfv2(user string, passwd string, userDom string) []byte {
+	return ntowfv2FromHash(user, md4(utf16FromString(passwd)), userDom)
+}
+
+// NTOWFv2 computed from the NT hash of the password instead of the password itself
+func ntowfv2FromHash(user string, ntHash []byte, userDom string) []byte {
 	concat := utf16FromString(strings.ToUpper(user) + userDom)
-	return hmacMd5(md4(utf16FromString(passwd)), concat)
+	return hmacMd5(ntHash, concat)
 }
 
 // Define lmowfv2(Passwd, User, UserDom) as
@@ -406,3 +678,8 @@ func timeToWindowsFileTime(t time.Time) []byte {
 	binary.Write(buffer, binary.LittleEndian, ll)
 	return buffer.Bytes()
 }
+
+func windowsFileTimeToTime(fileTime []byte) time.Time {
+	ll := int64(binary.LittleEndian.Uint64(fileTime)) - int64(116444736000000000)
+	return time.Unix(ll/10000000, (ll%10000000)*100)
+}
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -65,7 +66,7 @@ func TestNTLMv2(t *testing.T) {
 	challengeMessageBytes, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef00000000000000002400240044000000060070170000000f53006500720076006500720002000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
 	challengeMessage, err := ParseChallengeMessage(challengeMessageBytes)
 	if err == nil {
-		challengeMessage.String()
+		_ = challengeMessage.String()
 	} else {
 		t.Errorf("Could not parse challenge message: %s", err)
 	}
@@ -100,7 +101,7 @@ func TestNTLMv2(t *testing.T) {
 
 	authenticateMessage, err := ParseAuthenticateMessage(authenticateMessageBytes, 2)
 	if err == nil {
-		authenticateMessage.String()
+		_ = authenticateMessage.String()
 	} else {
 		t.Errorf("Could not parse authenticate message: %s", err)
 	}
@@ -119,7 +120,7 @@ func TestNTLMv2(t *testing.T) {
 
 	// Have the server generate an initial challenge message
 	challenge, err := server.GenerateChallengeMessage()
-	challenge.String()
+	_ = challenge.String()
 
 	// Have the client process this server challenge message
 	client = new(V2ClientSession)
@@ -187,3 +188,608 @@ func TestWindowsTimeConversion(t *testing.T) {
 	result := timeToWindowsFileTime(unix)
 	checkV2Value(t, "Timestamp", result, "0090d336b734c301", nil)
 }
+
+// Runs a full NTLMv2 handshake between a client and a server session over the serialized messages
+func runV2Handshake(t *testing.T, client *V2ClientSession, server *V2ServerSession, withNegotiate bool) (*AuthenticateMessage, error) {
+	if withNegotiate {
+		nm, err := client.GenerateNegotiateMessage()
+		if err != nil {
+			t.Fatalf("Could not generate negotiate message: %s", err)
+		}
+		nm, err = ParseNegotiateMessage(nm.Bytes())
+		if err != nil {
+			t.Fatalf("Could not parse negotiate message: %s", err)
+		}
+		server.ProcessNegotiateMessage(nm)
+	}
+
+	cm, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("Could not generate challenge message: %s", err)
+	}
+	cm, err = ParseChallengeMessage(cm.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+
+	err = client.ProcessChallengeMessage(cm)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+
+	am, err := client.GenerateAuthenticateMessage()
+	if err != nil {
+		t.Fatalf("Could not generate authenticate message: %s", err)
+	}
+	am, err = ParseAuthenticateMessage(am.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+
+	return am, server.ProcessAuthenticateMessage(am)
+}
+
+func TestNTLMv2Mic(t *testing.T) {
+	for _, withNegotiate := range []bool{false, true} {
+		client := new(V2ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		server := new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+
+		am, err := runV2Handshake(t, client, server, withNegotiate)
+		if err != nil {
+			t.Errorf("Could not authenticate with a MIC: %s", err)
+		}
+
+		avFlags := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.ByteValue(MsvAvFlags)
+		if len(avFlags) != 4 || avFlags[0]&0x02 == 0 {
+			t.Errorf("MsvAvFlags should indicate a MIC, got %s", hex.EncodeToString(avFlags))
+		}
+		if bytes.Equal(am.Mic, zeroBytes(16)) {
+			t.Error("MIC should be calculated")
+		}
+
+		// A changed MIC has to fail
+		am.Mic[0] = am.Mic[0] ^ 0xff
+		if server.ProcessAuthenticateMessage(am) == nil {
+			t.Error("Authenticate message with a wrong MIC should fail")
+		}
+
+		// As does a message where the MIC was dropped
+		am.Mic = nil
+		if server.ProcessAuthenticateMessage(am) == nil {
+			t.Error("Authenticate message without a MIC should fail")
+		}
+	}
+}
+
+func TestNTLMv2MicWithoutChallengeMessage(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	cm, _ := server.GenerateChallengeMessage()
+	client.ProcessChallengeMessage(cm)
+	am, _ := client.GenerateAuthenticateMessage()
+	am, _ = ParseAuthenticateMessage(am.Bytes(), 2)
+
+	// A session that only knows the server challenge can not verify the MIC the client announced, it only refuses
+	// the client when the configuration requires the MIC to be verified
+	server = new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerChallenge(cm.ServerChallenge)
+	if err := server.ProcessAuthenticateMessage(am); err != nil {
+		t.Errorf("Could not authenticate without the challenge message: %s", err)
+	}
+
+	server = new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerConfig(&ServerConfig{RequireMicVerification: true})
+	server.SetServerChallenge(cm.ServerChallenge)
+	if err := server.ProcessAuthenticateMessage(am); !errors.Is(err, ErrMicMismatch) {
+		t.Errorf("Expected MIC error got %v", err)
+	}
+}
+
+func TestNTLMv2StatelessServerMic(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+
+	// The session that sends the challenge is not the one that gets the AUTHENTICATE_MESSAGE
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	cm, _ := server.GenerateChallengeMessage()
+	challengeBytes := cm.Bytes()
+
+	cm, _ = ParseChallengeMessage(challengeBytes)
+	client.ProcessChallengeMessage(cm)
+	am, _ := client.GenerateAuthenticateMessage()
+	authenticateBytes := am.Bytes()
+
+	for _, tamper := range []bool{false, true} {
+		am, _ = ParseAuthenticateMessage(authenticateBytes, 2)
+		if tamper {
+			am.Mic = make([]byte, 16)
+		}
+		cm, _ = ParseChallengeMessage(challengeBytes)
+		server = new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		server.SetServerConfig(&ServerConfig{RequireMicVerification: true})
+		server.SetChallengeMessage(cm)
+
+		err := server.ProcessAuthenticateMessage(am)
+		if tamper && !errors.Is(err, ErrMicMismatch) {
+			t.Errorf("Expected MIC error got %v", err)
+		}
+		if !tamper && err != nil {
+			t.Errorf("Could not authenticate with the restored challenge message: %s", err)
+		}
+	}
+}
+
+func TestNTLMv2ConnectionOrientedMac(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetMode(ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(am.NegotiateFlags) {
+		t.Error("Connection oriented sessions should not negotiate NTLMSSP_NEGOTIATE_DATAGRAM")
+	}
+
+	// The sequence numbers are tracked by the sessions
+	messages := []string{"<NTLM><foo><bar>", "second message", "third message"}
+	for i, message := range messages {
+		mac, _ := client.Mac([]byte(message))
+		if !bytes.Equal(mac[12:16], uint32ToBytes(uint32(i))) {
+			t.Errorf("Client sequence number should be %d got %s", i, hex.EncodeToString(mac[12:16]))
+		}
+		matches, _ := server.VerifyMac([]byte(message), mac)
+		if !matches {
+			t.Errorf("Server could not verify client message %d", i)
+		}
+
+		mac, _ = server.Mac([]byte(message))
+		matches, _ = client.VerifyMac([]byte(message), mac)
+		if !matches {
+			t.Errorf("Client could not verify server message %d", i)
+		}
+	}
+
+	// A signature that does not verify leaves the session as it was
+	mac, _ := client.Mac([]byte("replayed"))
+	if matches, _ := server.VerifyMac([]byte("changed"), mac); matches {
+		t.Error("Signature of another message should not verify")
+	}
+	if matches, _ := server.VerifyMac([]byte("replayed"), mac); !matches {
+		t.Error("Signature should verify after a failed verification")
+	}
+
+	// Replaying a signature fails since the server has moved on to the next sequence number
+	if matches, _ := server.VerifyMac([]byte("replayed"), mac); matches {
+		t.Error("Replayed signature should not verify")
+	}
+}
+
+func TestNTLMv2ConnectionlessMac(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	am, err := runV2Handshake(t, client, server, false)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+	if !NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(am.NegotiateFlags) {
+		t.Error("Connectionless sessions should negotiate NTLMSSP_NEGOTIATE_DATAGRAM")
+	}
+
+	// Connectionless sessions sign with the application supplied sequence numbers
+	sig := "<NTLM><foo><bar>"
+	if _, err = client.Mac([]byte(sig)); err == nil {
+		t.Error("Mac should need the sequence number in connectionless mode")
+	}
+	mac, _ := client.SignDatagram([]byte(sig), 100)
+	expected := NtlmV2Mac([]byte(sig), 100, nil, client.ClientSealingKey, client.ClientSigningKey, client.NegotiateFlags)
+	if !bytes.Equal(mac, expected) {
+		t.Errorf("SignDatagram should compute the connectionless MAC, got %s expected %s", hex.EncodeToString(mac), hex.EncodeToString(expected))
+	}
+}
+
+func TestNTLMv2SealUnseal(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetMode(ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	_, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	for _, message := range []string{"Plaintext", "another message", ""} {
+		sealed, signature, err := client.Seal([]byte(message))
+		if err != nil {
+			t.Fatalf("Could not seal message: %s", err)
+		}
+		if len(message) > 0 && bytes.Equal(sealed, []byte(message)) {
+			t.Error("Sealed message should not be the plaintext")
+		}
+		if len(signature) != 16 {
+			t.Errorf("Signature should be 16 bytes got %d", len(signature))
+		}
+		plaintext, err := server.Unseal(sealed, signature)
+		if err != nil || string(plaintext) != message {
+			t.Errorf("Server could not unseal client message '%s': %s", message, err)
+		}
+
+		sealed, signature, _ = server.Seal([]byte(message))
+		plaintext, err = client.Unseal(sealed, signature)
+		if err != nil || string(plaintext) != message {
+			t.Errorf("Client could not unseal server message '%s': %s", message, err)
+		}
+	}
+
+	// A changed message is rejected and does not advance the session, so the original still unseals
+	sealed, signature, _ := client.Seal([]byte("Plaintext"))
+	changed := append([]byte{}, sealed...)
+	changed[0] = changed[0] ^ 0xff
+	if _, err = server.Unseal(changed, signature); err != ErrSignatureChecksum {
+		t.Errorf("Expected checksum error for a changed sealed message got %v", err)
+	}
+	if plaintext, err := server.Unseal(sealed, signature); err != nil || string(plaintext) != "Plaintext" {
+		t.Errorf("Server could not unseal the original message after a changed one: %v", err)
+	}
+
+	// A message that comes out of order has the wrong sequence number
+	first, firstSignature, _ := client.Seal([]byte("First"))
+	second, secondSignature, _ := client.Seal([]byte("Second"))
+	if _, err = server.Unseal(second, secondSignature); err != ErrSignatureSequence {
+		t.Errorf("Expected sequence error for a message out of order got %v", err)
+	}
+	if plaintext, err := server.Unseal(first, firstSignature); err != nil || string(plaintext) != "First" {
+		t.Errorf("Server could not unseal the first message: %v", err)
+	}
+
+	if _, _, err = client.SealDatagram([]byte("Plaintext"), 0); err == nil {
+		t.Error("Connection oriented sessions should not take a sequence number")
+	}
+}
+
+func TestNTLMv2SealUnsealDatagram(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	_, err := runV2Handshake(t, client, server, false)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	// Datagrams can be lost and arrive in any order, each is unsealed with its own sequence number
+	messages := []string{"First", "Second", "Third"}
+	sealed := make([][]byte, len(messages))
+	signatures := make([][]byte, len(messages))
+	for i, message := range messages {
+		sealed[i], signatures[i], err = client.SealDatagram([]byte(message), uint32(i))
+		if err != nil {
+			t.Fatalf("Could not seal message: %s", err)
+		}
+	}
+
+	changed := append([]byte{}, sealed[2]...)
+	changed[0] = changed[0] ^ 0xff
+	if _, err = server.UnsealDatagram(changed, signatures[2], 2); err != ErrSignatureChecksum {
+		t.Errorf("Expected checksum error for a changed datagram got %v", err)
+	}
+	for _, i := range []int{2, 0} {
+		plaintext, err := server.UnsealDatagram(sealed[i], signatures[i], uint32(i))
+		if err != nil || string(plaintext) != messages[i] {
+			t.Errorf("Server could not unseal datagram %d: %v", i, err)
+		}
+	}
+	if _, err = server.UnsealDatagram(sealed[0], signatures[0], 1); err != ErrSignatureSequence {
+		t.Errorf("Expected sequence error for a datagram with another sequence number got %v", err)
+	}
+
+	if _, _, err = client.Seal([]byte("Plaintext")); err == nil {
+		t.Error("Connectionless sessions should need the sequence number")
+	}
+}
+
+func TestNTLMv2SignVerifySignature(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetMode(ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	_, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	for _, message := range []string{"First message", "Second message"} {
+		signature, err := client.Sign([]byte(message))
+		if err != nil || len(signature) != 16 {
+			t.Fatalf("Could not sign message: %s", err)
+		}
+		envelope := SignedEnvelope([]byte(message), signature)
+		m, s, err := OpenSignedEnvelope(envelope)
+		if err != nil || string(m) != message || !bytes.Equal(s, signature) {
+			t.Errorf("Signed envelope did not round trip: %s", err)
+		}
+		if err = server.VerifySignature(m, s); err != nil {
+			t.Errorf("Server could not verify client signature: %s", err)
+		}
+
+		signature, _ = server.Sign([]byte(message))
+		if err = client.VerifySignature([]byte(message), signature); err != nil {
+			t.Errorf("Client could not verify server signature: %s", err)
+		}
+	}
+
+	// Failed verifications do not advance the session, the next message still verifies
+	signature, _ := client.Sign([]byte("Message"))
+	if err = server.VerifySignature([]byte("Changed"), signature); err != ErrSignatureChecksum {
+		t.Errorf("Expected checksum error got %v", err)
+	}
+	changed := append([]byte{}, signature...)
+	changed[0] = 2
+	if err = server.VerifySignature([]byte("Message"), changed); err != ErrSignatureVersion {
+		t.Errorf("Expected version error got %v", err)
+	}
+	if err = server.VerifySignature([]byte("Message"), signature); err != nil {
+		t.Errorf("Server could not verify the signature after failed verifications: %s", err)
+	}
+
+	// Skip a message, the server expects the sequence number of the lost one
+	client.Sign([]byte("Lost"))
+	signature, _ = client.Sign([]byte("Message"))
+	if err = server.VerifySignature([]byte("Message"), signature); err != ErrSignatureSequence {
+		t.Errorf("Expected sequence error got %v", err)
+	}
+}
+
+func TestNTLMv2SignVerifyDatagramSignature(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	_, err := runV2Handshake(t, client, server, false)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	first, _ := client.SignDatagram([]byte("First"), 10)
+	second, _ := client.SignDatagram([]byte("Second"), 11)
+	if err = server.VerifyDatagramSignature([]byte("Second"), second, 11); err != nil {
+		t.Errorf("Server could not verify the second datagram first: %s", err)
+	}
+	if err = server.VerifyDatagramSignature([]byte("Changed"), first, 10); err != ErrSignatureChecksum {
+		t.Errorf("Expected checksum error got %v", err)
+	}
+	if err = server.VerifyDatagramSignature([]byte("First"), first, 10); err != nil {
+		t.Errorf("Server could not verify the first datagram: %s", err)
+	}
+	if err = server.VerifyDatagramSignature([]byte("First"), first, 12); err != ErrSignatureSequence {
+		t.Errorf("Expected sequence error got %v", err)
+	}
+
+	if _, err = client.Sign([]byte("Message")); err == nil {
+		t.Error("Connectionless sessions should need the sequence number")
+	}
+}
+
+func TestNTLMv2NegotiatedChallengeFlags(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	requested := defaultV2ClientFlags()
+	requested = NTLMSSP_NEGOTIATE_SEAL.Unset(requested)
+	client.SetRequestedFlags(requested)
+	server := new(V2ServerSession)
+	server.SetMode(ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(am.NegotiateFlags) || NTLMSSP_NEGOTIATE_SEAL.IsSet(am.NegotiateFlags) {
+		t.Error("DATAGRAM and SEAL should not be negotiated")
+	}
+	if !NTLMSSP_NEGOTIATE_SIGN.IsSet(am.NegotiateFlags) {
+		t.Error("SIGN should be negotiated")
+	}
+	if _, _, err = client.Seal([]byte("Plaintext")); err == nil {
+		t.Error("Sealing should fail when SEAL was not negotiated")
+	}
+}
+
+func TestNTLMv2AuthenticateFlags(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	client.SetRequestedFlags(NTLMSSP_NEGOTIATE_SEAL.Unset(defaultV2ClientFlags()))
+	server := new(V2ServerSession)
+	server.SetMode(ConnectionOrientedMode)
+	server.SetUserInfo("User", "Password", "Domain", "")
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	// SEAL was not negotiated, the client can't turn it on in the AUTHENTICATE_MESSAGE
+	am.NegotiateFlags = NTLMSSP_NEGOTIATE_SEAL.Set(am.NegotiateFlags)
+	err = server.ProcessAuthenticateMessage(am)
+	if !errors.Is(err, ErrLogonFailure) || errors.Is(err, ErrMicMismatch) {
+		t.Errorf("Flags that were not negotiated should be refused got %v", err)
+	}
+	if NTLMSSP_NEGOTIATE_SEAL.IsSet(server.NegotiateFlags) {
+		t.Error("Server should not take flags that were not negotiated")
+	}
+
+	// Leaving out a flag that was offered is allowed, and flags that don't change the security of the session are
+	// not compared
+	changes := []struct {
+		name   string
+		change func(flags uint32) uint32
+	}{
+		{"without ALWAYS_SIGN", NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Unset},
+		{"with OEM and UNICODE", NTLM_NEGOTIATE_OEM.Set},
+		{"with REQUEST_TARGET and TARGET_TYPE_SERVER", func(flags uint32) uint32 {
+			return NTLMSSP_TARGET_TYPE_SERVER.Set(NTLMSSP_REQUEST_TARGET.Set(flags))
+		}},
+	}
+	for _, change := range changes {
+		client = new(V2ClientSession)
+		client.SetMode(ConnectionOrientedMode)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		server = new(V2ServerSession)
+		server.SetMode(ConnectionOrientedMode)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		cm, err := server.GenerateChallengeMessage()
+		if err != nil {
+			t.Fatalf("Could not generate challenge message: %s", err)
+		}
+		err = client.ProcessChallengeMessage(cm)
+		if err != nil {
+			t.Fatalf("Could not process challenge message: %s", err)
+		}
+		client.NegotiateFlags = change.change(client.NegotiateFlags)
+		am, err = client.GenerateAuthenticateMessage()
+		if err != nil {
+			t.Fatalf("Could not generate authenticate message: %s", err)
+		}
+		am, err = ParseAuthenticateMessage(am.Bytes(), 2)
+		if err != nil {
+			t.Fatalf("Could not parse authenticate message: %s", err)
+		}
+		err = server.ProcessAuthenticateMessage(am)
+		if err != nil {
+			t.Errorf("Could not authenticate %s: %s", change.name, err)
+		}
+	}
+}
+
+func TestNTLMv2ServerTimestamp(t *testing.T) {
+	for _, serverTimestamp := range []bool{false, true} {
+		client := new(V2ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		server := new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		server.SetServerConfig(&ServerConfig{NetBIOSComputerName: "SERVER", NetBIOSDomainName: "DOMAIN", Timestamp: serverTimestamp})
+
+		am, err := runV2Handshake(t, client, server, true)
+		if err != nil {
+			t.Fatalf("Could not authenticate: %s", err)
+		}
+
+		pairs := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs
+		if !bytes.Equal(pairs.ByteValue(MsvAvFlags), uint32ToBytes(uint32(AvFlagMicProvided))) {
+			t.Error("Client should set the MIC flag in MsvAvFlags")
+		}
+
+		zeroLm := bytes.Equal(am.LmChallengeResponse.Payload, zeroBytes(24))
+		if zeroLm != serverTimestamp {
+			t.Errorf("LmChallengeResponse should be zero: %v", serverTimestamp)
+		}
+		if serverTimestamp {
+			if !bytes.Equal(am.NtlmV2Response.NtlmV2ClientChallenge.TimeStamp, pairs.ByteValue(MsvAvTimestamp)) {
+				t.Error("Client should use the timestamp of the server")
+			}
+		}
+	}
+}
+
+// Changes the AvPairs in the NTLMv2 response of a message, which invalidates the NTProofStr but not the LMv2 response
+func tamperAvPairs(t *testing.T, am *AuthenticateMessage, change func(pairs *AvPairs)) *AuthenticateMessage {
+	am, err := ParseAuthenticateMessage(am.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	pairs := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs
+	original := pairs.Bytes()
+	change(pairs)
+
+	payload := am.NtChallengeResponseFields.Payload
+	offset := bytes.Index(payload, original)
+	tampered := concat(payload[:offset], pairs.Bytes(), payload[offset+len(original):])
+	am.NtChallengeResponseFields, _ = CreateBytePayload(tampered)
+
+	am, err = ParseAuthenticateMessage(am.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("Could not parse tampered authenticate message: %s", err)
+	}
+	return am
+}
+
+func TestNTLMv2LmV2FallbackWithTamperedAvPairs(t *testing.T) {
+	bindings := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:certificate hash")}
+	other := &ChannelBindings{ApplicationData: []byte("tls-server-end-point:other hash")}
+
+	tests := []struct {
+		name   string
+		policy ChannelBindingPolicy
+		change func(pairs *AvPairs)
+	}{
+		{"MIC flag cleared", ChannelBindingOff, func(pairs *AvPairs) { pairs.SetFlags(0) }},
+		{"channel bindings changed", ChannelBindingRequire, func(pairs *AvPairs) {
+			pairs.SetFlags(0)
+			pairs.SetOrReplace(MsvChannelBindings, other.Hash())
+		}},
+	}
+
+	for _, test := range tests {
+		client := new(V2ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		client.SetChannelBindings(bindings)
+		server := new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		server.SetChannelBindings(other)
+		server.SetChannelBindingPolicy(test.policy)
+
+		cm, _ := server.GenerateChallengeMessage()
+		client.ProcessChallengeMessage(cm)
+		am, _ := client.GenerateAuthenticateMessage()
+		if len(am.LmChallengeResponse.Payload) != 24 || bytes.Equal(am.LmChallengeResponse.Payload, zeroBytes(24)) {
+			t.Fatalf("%s: client should send an LMv2 response", test.name)
+		}
+
+		am = tamperAvPairs(t, am, test.change)
+		if err := server.ProcessAuthenticateMessage(am); !errors.Is(err, ErrLogonFailure) {
+			t.Errorf("%s: tampered AvPairs should not be accepted through the LMv2 response, got %v", test.name, err)
+		}
+	}
+
+	// Without anything that relies on the AvPairs the LMv2 response is still accepted
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	cm, _ := server.GenerateChallengeMessage()
+	client.ProcessChallengeMessage(cm)
+	am, _ := client.GenerateAuthenticateMessage()
+	am = tamperAvPairs(t, am, func(pairs *AvPairs) { pairs.SetFlags(0) })
+
+	server = new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerChallenge(cm.ServerChallenge)
+	if err := server.ProcessAuthenticateMessage(am); err != nil {
+		t.Errorf("LMv2 response should be accepted when the AvPairs are not checked: %s", err)
+	}
+}
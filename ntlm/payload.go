@@ -40,7 +40,7 @@ func (p *PayloadStruct) String() string {
 	case UnicodeStringPayload:
 		returnString = utf16ToString(p.Payload)
 	case OemStringPayload:
-		returnString = string(p.Payload)
+		returnString = CodePage437.Decode(p.Payload)
 	case BytesPayload:
 		returnString = hex.EncodeToString(p.Payload)
 	default:
@@ -69,15 +69,39 @@ func CreateStringPayload(value string) (*PayloadStruct, error) {
 	return p, nil
 }
 
+// Create an OEM string payload in CodePage437, this is used for the domain and workstation names in the
+// NEGOTIATE_MESSAGE and for the names in the other messages when NTLMSSP_NEGOTIATE_UNICODE is not negotiated
+func CreateOemStringPayload(value string) (*PayloadStruct, error) {
+	return createOemStringPayload(value, CodePage437), nil
+}
+
+func createOemStringPayload(value string, codePage *CodePage) *PayloadStruct {
+	bytes := codePage.Encode(value)
+	p := new(PayloadStruct)
+	p.Type = OemStringPayload
+	p.Len = uint16(len(bytes))
+	p.MaxLen = uint16(len(bytes))
+	p.Payload = bytes
+	return p
+}
+
 func ReadStringPayload(startByte int, bytes []byte) (*PayloadStruct, error) {
 	return ReadPayloadStruct(startByte, bytes, UnicodeStringPayload)
 }
 
+func ReadOemStringPayload(startByte int, bytes []byte) (*PayloadStruct, error) {
+	return ReadPayloadStruct(startByte, bytes, OemStringPayload)
+}
+
 func ReadBytePayload(startByte int, bytes []byte) (*PayloadStruct, error) {
 	return ReadPayloadStruct(startByte, bytes, BytesPayload)
 }
 
 func ReadPayloadStruct(startByte int, bytes []byte, PayloadType int) (*PayloadStruct, error) {
+	if startByte < 0 || startByte+8 > len(bytes) {
+		return nil, newError(ErrMalformedMessage, "Payload fields are outside of the message")
+	}
+
 	p := new(PayloadStruct)
 
 	p.Type = PayloadType
@@ -86,7 +110,13 @@ func ReadPayloadStruct(startByte int, bytes []byte, PayloadType int) (*PayloadSt
 	p.Offset = binary.LittleEndian.Uint32(bytes[startByte+4 : startByte+8])
 
 	if p.Len > 0 {
-		endOffset := p.Offset + uint32(p.Len)
+		if p.MaxLen < p.Len {
+			return nil, newError(ErrMalformedMessage, "Payload length is larger than its maximum length")
+		}
+		endOffset := uint64(p.Offset) + uint64(p.Len)
+		if endOffset > uint64(len(bytes)) {
+			return nil, newError(ErrMalformedMessage, "Payload is outside of the message")
+		}
 		p.Payload = bytes[p.Offset:endOffset]
 	}
 
@@ -0,0 +1,132 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStaleResponse is returned when the timestamp of an NTLMv2 response is further from the server time than allowed
+	ErrStaleResponse = &Error{Status: STATUS_TIME_DIFFERENCE_AT_DC, Message: "NTLMv2 response timestamp is outside the allowed clock skew", Err: ErrLogonFailure}
+	// ErrReplayedResponse is returned when an NTLMv2 response was already accepted before
+	ErrReplayedResponse = newError(ErrLogonFailure, "NTLMv2 response was already used")
+	// ErrReplayCacheFull is returned when the ReplayCache can not remember another response until some of its
+	// responses expire
+	ErrReplayCacheFull = &Error{Status: STATUS_INSUFFICIENT_RESOURCES, Message: "Replay cache is full"}
+)
+
+// ReplayCache remembers the (server challenge, client challenge, user) of accepted NTLMv2 responses until they
+// expire. It holds at most a fixed number of entries. When it is full new responses are refused until entries
+// expire, since dropping a response that has not expired would let it be replayed. A ReplayCache can be shared
+// between sessions and goroutines.
+type ReplayCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	lifetime   time.Duration
+	entries    map[string]time.Time
+	// Keys in the order they were added, which is also the order in which they expire
+	order []string
+	now   func() time.Time
+}
+
+// NewReplayCache creates a cache for at most maxEntries responses that are remembered for lifetime. The lifetime
+// should be at least twice the MaxClockSkew of the server, so a response is remembered for as long as its timestamp
+// would be accepted. maxEntries should be larger than the number of logons the server accepts in that time.
+// NewReplayCache panics when maxEntries is not positive, since such a cache would refuse every response.
+func NewReplayCache(maxEntries int, lifetime time.Duration) *ReplayCache {
+	if maxEntries <= 0 {
+		panic("ntlm: NewReplayCache called with a maxEntries that is not positive")
+	}
+	return &ReplayCache{
+		maxEntries: maxEntries,
+		lifetime:   lifetime,
+		entries:    make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Add remembers a response. It returns false when the response is already in the cache, or when the cache is full.
+func (c *ReplayCache) Add(serverChallenge, clientChallenge []byte, user string) bool {
+	return c.add(serverChallenge, clientChallenge, user) == nil
+}
+
+// Contains returns true when a response is in the cache and has not expired
+func (c *ReplayCache) Contains(serverChallenge, clientChallenge []byte, user string) bool {
+	key := replayCacheKey(serverChallenge, clientChallenge, user)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire(c.now())
+	_, found := c.entries[key]
+	return found
+}
+
+func (c *ReplayCache) add(serverChallenge, clientChallenge []byte, user string) error {
+	key := replayCacheKey(serverChallenge, clientChallenge, user)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.expire(now)
+
+	if _, found := c.entries[key]; found {
+		return ErrReplayedResponse
+	}
+	if len(c.order) >= c.maxEntries {
+		return ErrReplayCacheFull
+	}
+
+	c.entries[key] = now.Add(c.lifetime)
+	c.order = append(c.order, key)
+	return nil
+}
+
+func replayCacheKey(serverChallenge, clientChallenge []byte, user string) string {
+	return string(concat(serverChallenge, clientChallenge, []byte(strings.ToUpper(user))))
+}
+
+// Len returns the number of responses in the cache
+func (c *ReplayCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.order)
+}
+
+func (c *ReplayCache) expire(now time.Time) {
+	for len(c.order) > 0 && !now.Before(c.entries[c.order[0]]) {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// Rejects NTLMv2 responses with a timestamp outside the allowed clock skew and responses that were seen before
+func (n *SessionData) checkFreshness(challenge *NtlmV2ClientChallenge) error {
+	config := n.config()
+
+	if config.MaxClockSkew > 0 {
+		skew := time.Since(windowsFileTimeToTime(challenge.TimeStamp))
+		if skew > config.MaxClockSkew || skew < -config.MaxClockSkew {
+			return ErrStaleResponse
+		}
+	}
+
+	if config.ReplayCache != nil && config.ReplayCache.Contains(n.serverChallenge, challenge.ChallengeFromClient, n.user) {
+		return ErrReplayedResponse
+	}
+	return nil
+}
+
+// Adds an accepted NTLMv2 response to the replay cache. This is only done once the whole message, including its MIC,
+// was accepted, so a tampered copy that is sent first can't get the real message rejected as a replay.
+func (n *SessionData) rememberResponse(challenge *NtlmV2ClientChallenge) error {
+	config := n.config()
+	if config.ReplayCache == nil {
+		return nil
+	}
+	return config.ReplayCache.add(n.serverChallenge, challenge.ChallengeFromClient, n.user)
+}
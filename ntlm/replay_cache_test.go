@@ -0,0 +1,157 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewReplayCacheInvalidSize(t *testing.T) {
+	for _, maxEntries := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewReplayCache(%d) should panic", maxEntries)
+				}
+			}()
+			NewReplayCache(maxEntries, time.Minute)
+		}()
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	cache := NewReplayCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	if !cache.Add([]byte("server1"), []byte("client1"), "User") {
+		t.Error("New response should be added")
+	}
+	if cache.Add([]byte("server1"), []byte("client1"), "USER") {
+		t.Error("Replayed response should not be added")
+	}
+	if !cache.Add([]byte("server1"), []byte("client1"), "Other") {
+		t.Error("Response of another user should be added")
+	}
+
+	// The cache is full, new responses are refused until the others expire
+	if cache.Add([]byte("server2"), []byte("client2"), "User") {
+		t.Error("Response should not be added to a full cache")
+	}
+	if err := cache.add([]byte("server2"), []byte("client2"), "User"); err != ErrReplayCacheFull {
+		t.Errorf("Expected replay cache full error got %v", err)
+	}
+	if !cache.Contains([]byte("server1"), []byte("client1"), "user") || cache.Len() != 2 {
+		t.Error("Responses in a full cache should be kept")
+	}
+
+	now = now.Add(time.Minute)
+	if cache.Contains([]byte("server1"), []byte("client1"), "User") {
+		t.Error("Expired responses should not be found")
+	}
+	if !cache.Add([]byte("server2"), []byte("client2"), "User") || cache.Len() != 1 {
+		t.Error("Expired responses should be removed")
+	}
+}
+
+func TestWindowsFileTimeConversion(t *testing.T) {
+	unix := time.Unix(1055844000, 0)
+	if !windowsFileTimeToTime(timeToWindowsFileTime(unix)).Equal(unix) {
+		t.Error("Time is not the same after a round trip")
+	}
+}
+
+func TestNTLMv2TimestampSkew(t *testing.T) {
+	server := new(V2ServerSession)
+	server.SetServerConfig(&ServerConfig{MaxClockSkew: 5 * time.Minute})
+
+	for _, offset := range []time.Duration{0, -4 * time.Minute, 4 * time.Minute} {
+		challenge := &NtlmV2ClientChallenge{TimeStamp: timeToWindowsFileTime(time.Now().Add(offset))}
+		if err := server.checkFreshness(challenge); err != nil {
+			t.Errorf("Timestamp %s from now should be accepted: %s", offset, err)
+		}
+	}
+	for _, offset := range []time.Duration{-6 * time.Minute, 6 * time.Minute} {
+		challenge := &NtlmV2ClientChallenge{TimeStamp: timeToWindowsFileTime(time.Now().Add(offset))}
+		if err := server.checkFreshness(challenge); err != ErrStaleResponse {
+			t.Errorf("Timestamp %s from now should be stale got %v", offset, err)
+		}
+	}
+}
+
+func TestNTLMv2ReplayedResponse(t *testing.T) {
+	config := &ServerConfig{MaxClockSkew: 5 * time.Minute, ReplayCache: NewReplayCache(100, 10*time.Minute)}
+
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerConfig(config)
+
+	am, err := runV2Handshake(t, client, server, false)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+
+	err = server.ProcessAuthenticateMessage(am)
+	if err != ErrReplayedResponse {
+		t.Errorf("Expected replayed response error got %v", err)
+	}
+}
+
+func TestNTLMv2ReplayCacheTamperedMic(t *testing.T) {
+	config := &ServerConfig{ReplayCache: NewReplayCache(100, 10*time.Minute)}
+
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerConfig(config)
+
+	cm, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("Could not generate challenge message: %s", err)
+	}
+	cm, err = ParseChallengeMessage(cm.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+	err = client.ProcessChallengeMessage(cm)
+	if err != nil {
+		t.Fatalf("Could not process challenge message: %s", err)
+	}
+	am, err := client.GenerateAuthenticateMessage()
+	if err != nil {
+		t.Fatalf("Could not generate authenticate message: %s", err)
+	}
+	data := am.Bytes()
+
+	// A copy with a valid response but a broken MIC must not get the real message rejected as a replay
+	tampered, err := ParseAuthenticateMessage(data, 2)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	tampered.Mic = make([]byte, 16)
+	err = server.ProcessAuthenticateMessage(tampered)
+	if !errors.Is(err, ErrMicMismatch) {
+		t.Fatalf("Expected MIC mismatch got %v", err)
+	}
+	if config.ReplayCache.Len() != 0 {
+		t.Error("Rejected message should not be added to the replay cache")
+	}
+
+	am, err = ParseAuthenticateMessage(data, 2)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	err = server.ProcessAuthenticateMessage(am)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+	err = server.ProcessAuthenticateMessage(am)
+	if err != ErrReplayedResponse {
+		t.Errorf("Expected replayed response error got %v", err)
+	}
+}
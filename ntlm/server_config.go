@@ -0,0 +1,119 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerConfig holds the identity a server presents in its CHALLENGE_MESSAGE
+type ServerConfig struct {
+	// The names sent in the TargetInfo AV_PAIRs, empty names are left out
+	NetBIOSComputerName string
+	NetBIOSDomainName   string
+	DNSComputerName     string
+	DNSDomainName       string
+	DNSTreeName         string
+
+	// The TargetName sent when the client sets NTLMSSP_REQUEST_TARGET, and its type. TargetType must be
+	// NTLMSSP_TARGET_TYPE_DOMAIN, NTLMSSP_TARGET_TYPE_SERVER or 0 when the type is not sent.
+	TargetName string
+	TargetType NegotiateFlag
+
+	// When set the TargetInfo carries an MsvAvTimestamp with the current time of the server
+	Timestamp bool
+
+	// The version sent when NTLMSSP_NEGOTIATE_VERSION is negotiated
+	Version *VersionStruct
+
+	// The largest difference between the timestamp of an NTLMv2 response and the time of the server, Windows
+	// allows 5 minutes. When 0 the timestamp is not checked.
+	MaxClockSkew time.Duration
+	// Remembers the NTLMv2 responses the server accepted so they can't be replayed. Share one cache between
+	// all sessions of a server. When nil responses are not remembered.
+	ReplayCache *ReplayCache
+	// When set an NTLMv2 client that sends a MIC is refused by a session that can't verify it, because it only had
+	// its server challenge set with SetServerChallenge. Otherwise such a session accepts the client without
+	// verifying the MIC.
+	RequireMicVerification bool
+}
+
+// The identity used by servers that have no ServerConfig, it is worked out once per process
+var (
+	defaultConfigOnce sync.Once
+	defaultConfig     *ServerConfig
+)
+
+// Builds the default identity from the host name, like a Windows server that is not in a domain, which sends its
+// computer name as the NetBIOS domain name
+
+func defaultServerConfig() *ServerConfig {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	computer, domain := host, ""
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		computer, domain = host[:i], host[i+1:]
+	}
+	// NetBIOS names are at most 15 characters
+	netBIOSName := strings.ToUpper(computer)
+	if len(netBIOSName) > 15 {
+		netBIOSName = netBIOSName[:15]
+	}
+
+	return &ServerConfig{
+		NetBIOSComputerName: netBIOSName,
+		NetBIOSDomainName:   netBIOSName,
+		DNSComputerName:     host,
+		DNSDomainName:       domain,
+		DNSTreeName:         domain,
+		Version:             defaultVersion(),
+	}
+}
+
+// SetServerConfig sets the identity the server presents in its CHALLENGE_MESSAGE. Without a ServerConfig the server
+// sends names made from the host name of the machine.
+func (n *SessionData) SetServerConfig(config *ServerConfig) {
+	n.serverConfig = config
+}
+
+func (n *SessionData) config() *ServerConfig {
+	if n.serverConfig == nil {
+		defaultConfigOnce.Do(func() {
+			defaultConfig = defaultServerConfig()
+		})
+		return defaultConfig
+	}
+	return n.serverConfig
+}
+
+// Builds the TargetInfo AV_PAIRs of the CHALLENGE_MESSAGE from the configuration
+func (c *ServerConfig) targetInfo() *AvPairs {
+	pairs := new(AvPairs)
+	names := []struct {
+		avId  AvPairType
+		value string
+	}{
+		{MsvAvNbDomainName, c.NetBIOSDomainName},
+		{MsvAvNbComputerName, c.NetBIOSComputerName},
+		{MsvAvDnsDomainName, c.DNSDomainName},
+		{MsvAvDnsComputerName, c.DNSComputerName},
+		{MsvAvDnsTreeName, c.DNSTreeName},
+	}
+	for _, name := range names {
+		if name.value != "" {
+			pairs.AddAvPair(name.avId, utf16FromString(name.value))
+		}
+	}
+	if c.Timestamp {
+		pairs.AddAvPair(MsvAvTimestamp, timeToWindowsFileTime(time.Now()))
+	}
+	pairs.AddAvPair(MsvAvEOL, make([]byte, 0))
+	return pairs
+}
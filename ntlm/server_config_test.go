@@ -0,0 +1,83 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServerConfigChallenge(t *testing.T) {
+	config := &ServerConfig{
+		NetBIOSComputerName: "SERVER",
+		NetBIOSDomainName:   "EXAMPLE",
+		DNSComputerName:     "server.example.com",
+		DNSDomainName:       "example.com",
+		DNSTreeName:         "example.com",
+		TargetName:          "EXAMPLE",
+		TargetType:          NTLMSSP_TARGET_TYPE_DOMAIN,
+		Timestamp:           true,
+		Version:             &VersionStruct{ProductMajorVersion: 10, ProductMinorVersion: 0, ProductBuild: 17763, NTLMRevisionCurrent: 15},
+	}
+
+	server := new(V2ServerSession)
+	server.SetMode(ConnectionOrientedMode)
+	server.SetServerConfig(config)
+	client := new(V2ClientSession)
+	client.SetMode(ConnectionOrientedMode)
+	nm, _ := client.GenerateNegotiateMessage()
+	server.ProcessNegotiateMessage(nm)
+
+	cm, err := server.GenerateChallengeMessage()
+	if err != nil {
+		t.Fatalf("Could not generate challenge message: %s", err)
+	}
+	cm, err = ParseChallengeMessage(cm.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse challenge message: %s", err)
+	}
+
+	if cm.TargetName.String() != "EXAMPLE" || !NTLMSSP_TARGET_TYPE_DOMAIN.IsSet(cm.NegotiateFlags) || NTLMSSP_TARGET_TYPE_SERVER.IsSet(cm.NegotiateFlags) {
+		t.Errorf("Target name not correct got %s", cm.TargetName.String())
+	}
+	if cm.TargetInfo.StringValue(MsvAvNbComputerName) != "SERVER" || cm.TargetInfo.StringValue(MsvAvDnsDomainName) != "example.com" {
+		t.Errorf("TargetInfo not correct got %s", cm.TargetInfo.String())
+	}
+	if len(cm.TargetInfo.ByteValue(MsvAvTimestamp)) != 8 {
+		t.Error("TargetInfo should carry a timestamp")
+	}
+	if cm.Version.ProductBuild != 17763 {
+		t.Errorf("Version not correct got %s", cm.Version.String())
+	}
+}
+
+func TestDefaultServerConfigChallenge(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("Host name is not known: %s", err)
+	}
+	computer := strings.ToUpper(strings.SplitN(host, ".", 2)[0])
+	if len(computer) > 15 {
+		computer = computer[:15]
+	}
+
+	server := new(V2ServerSession)
+	cm, _ := server.GenerateChallengeMessage()
+	if cm.TargetInfo.StringValue(MsvAvNbComputerName) != computer || cm.TargetInfo.StringValue(MsvAvNbDomainName) != computer {
+		t.Errorf("Default NetBIOS names should be %s got %s", computer, cm.TargetInfo.String())
+	}
+	if cm.TargetInfo.StringValue(MsvAvDnsComputerName) != strings.TrimSuffix(host, ".") || cm.TargetInfo.Find(MsvAvTimestamp) != nil {
+		t.Errorf("Default TargetInfo not correct got %s", cm.TargetInfo.String())
+	}
+	if cm.Version.ProductBuild != 7601 {
+		t.Errorf("Default version not correct got %s", cm.Version.String())
+	}
+}
+
+func TestDefaultServerConfigOnce(t *testing.T) {
+	first, second := new(V2ServerSession), new(V1ServerSession)
+	if first.config() != second.config() {
+		t.Error("Default server config should be worked out once")
+	}
+}
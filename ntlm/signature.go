@@ -3,12 +3,28 @@
 package ntlm
 
 import (
+	"bytes"
 	rc4P "crypto/rc4"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 )
 
+var (
+	// ErrSignatureVersion is returned when a message signature is not a version 1 NTLMSSP_MESSAGE_SIGNATURE
+	ErrSignatureVersion = newError(ErrMessageAltered, "Message signature has the wrong version")
+	// ErrSignatureChecksum is returned when the checksum of a message signature does not match the message
+	ErrSignatureChecksum = newError(ErrMessageAltered, "Message signature checksum is not valid")
+	// ErrSignatureSequence is returned when a message signature was made for another sequence number
+	ErrSignatureSequence = newError(ErrMessageAltered, "Message signature has the wrong sequence number")
+
+	errNoIntegrity       = newError(ErrNegotiationFailure, "Message integrity was not negotiated for this session")
+	errNoConfidentiality = newError(ErrNegotiationFailure, "Message confidentiality was not negotiated for this session")
+
+	errSequenceNumberRequired = newError(ErrInvalidParameter, "Connectionless sessions need the sequence number of the message, use the Datagram methods")
+	errSequenceNumberNotUsed  = newError(ErrInvalidParameter, "Connection oriented sessions keep track of the sequence numbers, use the methods without one")
+)
+
 type NtlmsspMessageSignature struct {
 	ByteData []byte
 	// A 32-bit unsigned integer that contains the signature version. This field MUST be 0x00000001.
@@ -28,10 +44,8 @@ func (n *NtlmsspMessageSignature) String() string {
 func (n *NtlmsspMessageSignature) Bytes() []byte {
 	if n.ByteData != nil {
 		return n.ByteData
-	} else {
-		return concat(n.Version, n.RandomPad, n.CheckSum, n.SeqNum)
 	}
-	return nil
+	return concat(n.Version, n.RandomPad, n.CheckSum, n.SeqNum)
 }
 
 // Define SEAL(Handle, SigningKey, SeqNum, Message) as
@@ -119,6 +133,19 @@ func macWithExtendedSessionSecurity(negFlags uint32, handle *rc4P.Cipher, signin
 	return sig
 }
 
+// Returns the RC4 handle to use for a message in connectionless mode. With NTLMSSP_NEGOTIATE_DATAGRAM the handle
+// is re-initialized for every message, otherwise the given handle is used.
+func connectionlessHandle(handle *rc4P.Cipher, sealingKey []byte, sequenceNumber int, negFlags uint32) *rc4P.Cipher {
+	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(negFlags) && NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(negFlags) {
+		handle, _ = reinitSealingKey(sealingKey, sequenceNumber)
+	} else if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(negFlags) {
+		// CONOR: Reinitializing the rc4 cipher on every requst, but not using the
+		// algorithm as described in the MS-NTLM document. Just reinitialize it directly.
+		handle, _ = rc4Init(sealingKey)
+	}
+	return handle
+}
+
 func reinitSealingKey(key []byte, sequenceNumber int) (handle *rc4P.Cipher, err error) {
 	seqNumBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(seqNumBytes, uint32(sequenceNumber))
@@ -126,3 +153,251 @@ func reinitSealingKey(key []byte, sequenceNumber int) (handle *rc4P.Cipher, err
 	handle, err = rc4Init(newKey)
 	return handle, err
 }
+
+// Computes the signature of a message sent by the client
+func (n *SessionData) clientMac(message []byte) ([]byte, error) {
+	return n.sessionMac(message, n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey)
+}
+
+// Computes the signature of a message sent by the server
+func (n *SessionData) serverMac(message []byte) ([]byte, error) {
+	return n.sessionMac(message, n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey)
+}
+
+// Checks the signature of a message sent by the client
+func (n *SessionData) clientVerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.sessionVerifyMac(message, expectedMac, n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey)
+}
+
+// Checks the signature of a message sent by the server
+func (n *SessionData) serverVerifyMac(message, expectedMac []byte) (bool, error) {
+	return n.sessionVerifyMac(message, expectedMac, n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey)
+}
+
+// Mac and VerifyMac are only used in connection oriented mode, where the RC4 handle of a direction is used for every
+// message and the sequence number is the session's own counter. Unlike Sign they always compute the signature.
+func (n *SessionData) sessionMac(message []byte, handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey []byte) ([]byte, error) {
+	if err := n.checkSequenceNumber(nil); err != nil {
+		return nil, err
+	}
+	used, sequenceNumber := n.messageHandle(handle, seqNum, sealingKey, nil)
+	sig := mac(n.NegotiateFlags, used, signingKey, sequenceNumber, message)
+	n.acceptMessage(handle, used, seqNum)
+	return sig.Bytes(), nil
+}
+
+// The handle and the sequence number only advance when the signature matches
+func (n *SessionData) sessionVerifyMac(message, expectedMac []byte, handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey []byte) (bool, error) {
+	if err := n.checkSequenceNumber(nil); err != nil {
+		return false, err
+	}
+	used, sequenceNumber := n.messageHandle(handle, seqNum, sealingKey, nil)
+	sig := mac(n.NegotiateFlags, used, signingKey, sequenceNumber, message)
+	if !signaturesEqual(n.NegotiateFlags, sig.Bytes(), expectedMac) {
+		return false, nil
+	}
+	n.acceptMessage(handle, used, seqNum)
+	return true, nil
+}
+
+// Encrypts a message sent by the client and computes its signature
+func (n *SessionData) clientSeal(message []byte, sequenceNumber *uint32) ([]byte, []byte, error) {
+	return n.sessionSeal(message, sequenceNumber, n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey)
+}
+
+// Encrypts a message sent by the server and computes its signature
+func (n *SessionData) serverSeal(message []byte, sequenceNumber *uint32) ([]byte, []byte, error) {
+	return n.sessionSeal(message, sequenceNumber, n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey)
+}
+
+// Decrypts a message sent by the client and checks its signature
+func (n *SessionData) clientUnseal(message, signature []byte, sequenceNumber *uint32) ([]byte, error) {
+	return n.sessionUnseal(message, signature, sequenceNumber, n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey)
+}
+
+// Decrypts a message sent by the server and checks its signature
+func (n *SessionData) serverUnseal(message, signature []byte, sequenceNumber *uint32) ([]byte, error) {
+	return n.sessionUnseal(message, signature, sequenceNumber, n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey)
+}
+
+// Connection oriented sessions keep track of the sequence numbers themselves, connectionless sessions need the
+// sequence number the application supplies with every message
+func (n *SessionData) checkSequenceNumber(sequenceNumber *uint32) error {
+	if n.mode == ConnectionOrientedMode && sequenceNumber != nil {
+		return errSequenceNumberNotUsed
+	}
+	if n.mode != ConnectionOrientedMode && sequenceNumber == nil {
+		return errSequenceNumberRequired
+	}
+	return nil
+}
+
+// Returns the RC4 handle and sequence number for a message. In connection oriented mode these are a copy of the
+// handle of the direction and its sequence number. In connectionless mode the application supplies the sequence
+// number, with NTLMSSP_NEGOTIATE_DATAGRAM the handle is re-initialized for every message.
+func (n *SessionData) messageHandle(handle *rc4P.Cipher, seqNum *uint32, sealingKey []byte, sequenceNumber *uint32) (*rc4P.Cipher, uint32) {
+	if n.mode == ConnectionOrientedMode {
+		return copyHandle(handle), *seqNum
+	}
+	if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(n.NegotiateFlags) {
+		return connectionlessHandle(handle, sealingKey, int(*sequenceNumber), n.NegotiateFlags), *sequenceNumber
+	}
+	return copyHandle(handle), *sequenceNumber
+}
+
+// Stores the state of the RC4 handle a message was sent or verified with, in connection oriented mode the sequence
+// number of the direction advances. This is only done for messages that were accepted, so a message that fails to
+// verify leaves the session as it was.
+func (n *SessionData) acceptMessage(handle, used *rc4P.Cipher, seqNum *uint32) {
+	if n.mode == ConnectionOrientedMode {
+		*seqNum = *seqNum + 1
+	} else if NTLMSSP_NEGOTIATE_DATAGRAM.IsSet(n.NegotiateFlags) {
+		return
+	}
+	if handle != nil && used != nil {
+		*handle = *used
+	}
+}
+
+func copyHandle(handle *rc4P.Cipher) *rc4P.Cipher {
+	if handle == nil {
+		return nil
+	}
+	copied := *handle
+	return &copied
+}
+
+func (n *SessionData) sessionSeal(message []byte, sequenceNumber *uint32, handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey []byte) ([]byte, []byte, error) {
+	if err := n.checkSequenceNumber(sequenceNumber); err != nil {
+		return nil, nil, err
+	}
+	if !NTLMSSP_NEGOTIATE_SEAL.IsSet(n.NegotiateFlags) || len(sealingKey) == 0 {
+		return nil, nil, errNoConfidentiality
+	}
+	used, messageSeqNum := n.messageHandle(handle, seqNum, sealingKey, sequenceNumber)
+
+	sealed, sig := seal(n.NegotiateFlags, used, signingKey, messageSeqNum, message)
+	n.acceptMessage(handle, used, seqNum)
+	return sealed, sig.Bytes(), nil
+}
+
+func (n *SessionData) sessionUnseal(message, signature []byte, sequenceNumber *uint32, handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey []byte) ([]byte, error) {
+	if err := n.checkSequenceNumber(sequenceNumber); err != nil {
+		return nil, err
+	}
+	if !NTLMSSP_NEGOTIATE_SEAL.IsSet(n.NegotiateFlags) || len(sealingKey) == 0 {
+		return nil, errNoConfidentiality
+	}
+	used, messageSeqNum := n.messageHandle(handle, seqNum, sealingKey, sequenceNumber)
+
+	plaintext := rc4(used, message)
+	expected := mac(n.NegotiateFlags, used, signingKey, messageSeqNum, plaintext).Bytes()
+	if err := compareSignatures(n.NegotiateFlags, expected, signature); err != nil {
+		return nil, err
+	}
+	n.acceptMessage(handle, used, seqNum)
+	return plaintext, nil
+}
+
+// Computes the detached signature of a message sent by the client
+func (n *SessionData) clientSign(message []byte, sequenceNumber *uint32) ([]byte, error) {
+	return n.sessionSign(message, sequenceNumber, n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey)
+}
+
+// Computes the detached signature of a message sent by the server
+func (n *SessionData) serverSign(message []byte, sequenceNumber *uint32) ([]byte, error) {
+	return n.sessionSign(message, sequenceNumber, n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey)
+}
+
+// Checks the signature of a message sent by the client
+func (n *SessionData) clientVerifySignature(message, signature []byte, sequenceNumber *uint32) error {
+	return n.sessionVerifySignature(message, signature, sequenceNumber, n.clientHandle, &n.clientSeqNum, n.ClientSealingKey, n.ClientSigningKey)
+}
+
+// Checks the signature of a message sent by the server
+func (n *SessionData) serverVerifySignature(message, signature []byte, sequenceNumber *uint32) error {
+	return n.sessionVerifySignature(message, signature, sequenceNumber, n.serverHandle, &n.serverSeqNum, n.ServerSealingKey, n.ServerSigningKey)
+}
+
+// Signatures are only computed when NTLMSSP_NEGOTIATE_SIGN or NTLMSSP_NEGOTIATE_SEAL was negotiated. When only
+// NTLMSSP_NEGOTIATE_ALWAYS_SIGN was negotiated the dummy signature is used instead.
+func (n *SessionData) sessionSign(message []byte, sequenceNumber *uint32, handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey []byte) ([]byte, error) {
+	if err := n.checkSequenceNumber(sequenceNumber); err != nil {
+		return nil, err
+	}
+	if !NTLMSSP_NEGOTIATE_SIGN.IsSet(n.NegotiateFlags) && !NTLMSSP_NEGOTIATE_SEAL.IsSet(n.NegotiateFlags) {
+		if NTLMSSP_NEGOTIATE_ALWAYS_SIGN.IsSet(n.NegotiateFlags) {
+			return dummySignature(), nil
+		}
+		return nil, errNoIntegrity
+	}
+
+	used, messageSeqNum := n.messageHandle(handle, seqNum, sealingKey, sequenceNumber)
+	sig := mac(n.NegotiateFlags, used, signingKey, messageSeqNum, message)
+	n.acceptMessage(handle, used, seqNum)
+	return sig.Bytes(), nil
+}
+
+func (n *SessionData) sessionVerifySignature(message, signature []byte, sequenceNumber *uint32, handle *rc4P.Cipher, seqNum *uint32, sealingKey, signingKey []byte) error {
+	if err := n.checkSequenceNumber(sequenceNumber); err != nil {
+		return err
+	}
+	if !NTLMSSP_NEGOTIATE_SIGN.IsSet(n.NegotiateFlags) && !NTLMSSP_NEGOTIATE_SEAL.IsSet(n.NegotiateFlags) {
+		if !NTLMSSP_NEGOTIATE_ALWAYS_SIGN.IsSet(n.NegotiateFlags) {
+			return errNoIntegrity
+		}
+		return compareSignatures(n.NegotiateFlags, dummySignature(), signature)
+	}
+
+	used, messageSeqNum := n.messageHandle(handle, seqNum, sealingKey, sequenceNumber)
+	expected := mac(n.NegotiateFlags, used, signingKey, messageSeqNum, message).Bytes()
+	if err := compareSignatures(n.NegotiateFlags, expected, signature); err != nil {
+		return err
+	}
+	n.acceptMessage(handle, used, seqNum)
+	return nil
+}
+
+// The signature used when only NTLMSSP_NEGOTIATE_ALWAYS_SIGN was negotiated: a version of 1 followed by zeros
+func dummySignature() []byte {
+	return concat([]byte{0x01, 0x00, 0x00, 0x00}, zeroBytes(12))
+}
+
+// Compares a received signature with the expected one and reports which part of it is wrong
+func compareSignatures(negFlags uint32, expected, signature []byte) error {
+	if len(signature) != 16 || !bytes.Equal(signature[0:4], expected[0:4]) {
+		return ErrSignatureVersion
+	}
+	if !bytes.Equal(signature[12:16], expected[12:16]) {
+		return ErrSignatureSequence
+	}
+	if !signaturesEqual(negFlags, expected, signature) {
+		return ErrSignatureChecksum
+	}
+	return nil
+}
+
+// Compares two signatures in constant time. Without extended session security bytes 4-7 are the random pad, which
+// is ignored. With extended session security they are the first half of the checksum, so all 16 bytes are compared.
+func signaturesEqual(negFlags uint32, expected, signature []byte) bool {
+	if len(expected) != 16 || len(signature) != 16 {
+		return false
+	}
+	if NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.IsSet(negFlags) {
+		return hmacEqual(expected, signature)
+	}
+	return hmacEqual(concat(expected[0:4], expected[8:16]), concat(signature[0:4], signature[8:16]))
+}
+
+// SignedEnvelope returns the message followed by its signature, which is the form the SIGN function of MS-NLMP produces
+func SignedEnvelope(message, signature []byte) []byte {
+	return concat(message, signature)
+}
+
+// OpenSignedEnvelope splits a message created with SignedEnvelope into the message and its signature
+func OpenSignedEnvelope(envelope []byte) (message []byte, signature []byte, err error) {
+	if len(envelope) < 16 {
+		return nil, nil, newError(ErrMalformedMessage, "Signed envelope is too short to contain a message signature")
+	}
+	return envelope[:len(envelope)-16], envelope[len(envelope)-16:], nil
+}
@@ -64,3 +64,48 @@ func TestSealSignWithExtendedSessionSecurityKeyEx(t *testing.T) {
 	checkSigValue(t, "RC4 CheckSum", sig.CheckSum, "7fb38ec5c55d4976", nil)
 	checkSigValue(t, "Signature", sig.Bytes(), "010000007fb38ec5c55d497600000000", nil)
 }
+
+func TestDummySignature(t *testing.T) {
+	n := new(SessionData)
+	n.mode = ConnectionOrientedMode
+	n.NegotiateFlags = NTLMSSP_NEGOTIATE_ALWAYS_SIGN.Set(0)
+
+	signature, err := n.clientSign([]byte("Message"), nil)
+	checkSigValue(t, "Dummy signature", signature, "01000000000000000000000000000000", err)
+	if err = n.clientVerifySignature([]byte("Other message"), signature, nil); err != nil {
+		t.Errorf("Dummy signature should verify: %s", err)
+	}
+
+	n.NegotiateFlags = 0
+	if _, err = n.clientSign([]byte("Message"), nil); err == nil {
+		t.Error("Signing should fail when no integrity was negotiated")
+	}
+}
+
+func TestCompareSignatures(t *testing.T) {
+	signature, _ := hex.DecodeString("010000007fb38ec5c55d497600000000")
+	flags := NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY.Set(0)
+
+	changed := append([]byte{}, signature...)
+	changed[5] = changed[5] ^ 0xff
+	if err := compareSignatures(flags, signature, changed); err != ErrSignatureChecksum {
+		t.Errorf("Bytes 4-7 are part of the checksum with extended session security, got %v", err)
+	}
+	if err := compareSignatures(0, signature, changed); err != nil {
+		t.Errorf("Bytes 4-7 are the random pad without extended session security, got %v", err)
+	}
+
+	changed = append([]byte{}, signature...)
+	changed[11] = changed[11] ^ 0xff
+	for _, negFlags := range []uint32{0, flags} {
+		if err := compareSignatures(negFlags, signature, changed); err != ErrSignatureChecksum {
+			t.Errorf("Expected checksum error got %v", err)
+		}
+	}
+}
+
+func TestOpenSignedEnvelopeTooShort(t *testing.T) {
+	if _, _, err := OpenSignedEnvelope(make([]byte, 15)); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
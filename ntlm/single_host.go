@@ -0,0 +1,123 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// Mandatory integrity levels of Windows that are used in SubjectIntegrityLevel
+const (
+	IntegrityLevelUntrusted = uint32(0x00000000)
+	IntegrityLevelLow       = uint32(0x00001000)
+	IntegrityLevelMedium    = uint32(0x00002000)
+	IntegrityLevelHigh      = uint32(0x00003000)
+	IntegrityLevelSystem    = uint32(0x00004000)
+)
+
+// The size of a Single_Host_Data structure without additional data
+const singleHostDataSize = 48
+
+// SingleHostData is the Single_Host_Data structure (MS-NLMP 2.2.2.2, formerly Restriction_Encoding) that a client
+// sends in the MsvAvSingleHost AV_PAIR. When the MachineID is the one of the server the client runs on the same
+// host, Windows uses this to detect NTLM authentication that is reflected back to the host it came from.
+type SingleHostData struct {
+	// Non-zero when SubjectIntegrityLevel contains the integrity level of the client
+	IntegrityLevel uint32
+	// The mandatory integrity level of the security principal, one of the IntegrityLevel values
+	SubjectIntegrityLevel uint32
+	// A 32 byte value that is created when the machine starts and identifies it
+	MachineID []byte
+}
+
+// NewMachineID returns a random MachineID. Like the one Windows creates at startup it should be created once and
+// used by all sessions of the process.
+func NewMachineID() []byte {
+	return randomBytes(32)
+}
+
+func ReadSingleHostData(data []byte) (*SingleHostData, error) {
+	if len(data) < singleHostDataSize {
+		return nil, newError(ErrMalformedMessage, "Single_Host_Data must be at least 48 bytes")
+	}
+
+	size := binary.LittleEndian.Uint32(data[0:4])
+	if size < singleHostDataSize || size > uint32(len(data)) {
+		return nil, newError(ErrMalformedMessage, "Single_Host_Data size is not valid")
+	}
+
+	s := new(SingleHostData)
+	s.IntegrityLevel = binary.LittleEndian.Uint32(data[8:12])
+	s.SubjectIntegrityLevel = binary.LittleEndian.Uint32(data[12:16])
+	s.MachineID = data[16:48]
+	return s, nil
+}
+
+func (s *SingleHostData) Bytes() []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, singleHostDataSize))
+	binary.Write(buffer, binary.LittleEndian, uint32(singleHostDataSize))
+	buffer.Write(zeroBytes(4))
+	binary.Write(buffer, binary.LittleEndian, s.IntegrityLevel)
+	binary.Write(buffer, binary.LittleEndian, s.SubjectIntegrityLevel)
+
+	machineID := make([]byte, 32)
+	copy(machineID, s.MachineID)
+	buffer.Write(machineID)
+	return buffer.Bytes()
+}
+
+func (s *SingleHostData) String() string {
+	return fmt.Sprintf("IntegrityLevel: %d SubjectIntegrityLevel: 0x%08x MachineID: %s", s.IntegrityLevel, s.SubjectIntegrityLevel, hex.EncodeToString(s.MachineID))
+}
+
+// SingleHost returns the Single_Host_Data of MsvAvSingleHost, or nil when it is not present or not valid
+func (p *AvPairs) SingleHost() *SingleHostData {
+	value := p.ByteValue(MsvAvSingleHost)
+	if value == nil {
+		return nil
+	}
+	s, err := ReadSingleHostData(value)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func (p *AvPairs) SetSingleHost(s *SingleHostData) {
+	p.SetOrReplace(MsvAvSingleHost, s.Bytes())
+}
+
+// SetSingleHostData sets the Single_Host_Data an NTLMv2 client sends in its NTLMv2_CLIENT_CHALLENGE, NTLMv1 has
+// no place to send it
+func (n *SessionData) SetSingleHostData(data *SingleHostData) {
+	n.singleHostData = data
+}
+
+// SetMachineID sets the MachineID of the host the server runs on. NTLMv2 servers compare it with the MachineID in
+// the Single_Host_Data of the client to detect a loopback authentication.
+func (n *SessionData) SetMachineID(machineID []byte) {
+	n.machineID = machineID
+}
+
+// IsLoopback returns true when the client that authenticated sent the MachineID of the server, which means that it
+// runs on the same host
+func (n *SessionData) IsLoopback() bool {
+	return n.loopback
+}
+
+// Compares the MachineID of the client with the one of the server
+func (n *SessionData) checkLoopback(pairs *AvPairs) {
+	n.loopback = false
+	if len(n.machineID) != 32 || pairs == nil {
+		return
+	}
+
+	singleHost := pairs.SingleHost()
+	if singleHost != nil && bytes.Equal(singleHost.MachineID, n.machineID) {
+		n.loopback = true
+		n.log(LogDebug, "Client runs on the same host as the server")
+	}
+}
@@ -0,0 +1,100 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSingleHostData(t *testing.T) {
+	s := &SingleHostData{IntegrityLevel: 1, SubjectIntegrityLevel: IntegrityLevelHigh, MachineID: NewMachineID()}
+	data := s.Bytes()
+	if len(data) != 48 {
+		t.Fatalf("Single_Host_Data should be 48 bytes got %d", len(data))
+	}
+
+	read, err := ReadSingleHostData(data)
+	if err != nil {
+		t.Fatalf("Could not read Single_Host_Data: %s", err)
+	}
+	if read.IntegrityLevel != 1 || read.SubjectIntegrityLevel != IntegrityLevelHigh || !bytes.Equal(read.MachineID, s.MachineID) {
+		t.Errorf("Single_Host_Data is not the same after a round trip got %s", read)
+	}
+
+	if _, err = ReadSingleHostData(data[:47]); err == nil {
+		t.Error("Truncated Single_Host_Data should be an error")
+	}
+	data[0] = 64
+	if _, err = ReadSingleHostData(data); err == nil {
+		t.Error("Single_Host_Data with a size larger than the data should be an error")
+	}
+}
+
+func TestNTLMv2Loopback(t *testing.T) {
+	machineID := NewMachineID()
+	tests := []struct {
+		name     string
+		client   *SingleHostData
+		server   []byte
+		loopback bool
+	}{
+		{"same host", &SingleHostData{MachineID: machineID}, machineID, true},
+		{"other host", &SingleHostData{MachineID: NewMachineID()}, machineID, false},
+		{"no Single_Host_Data", nil, machineID, false},
+		{"no server MachineID", &SingleHostData{MachineID: machineID}, nil, false},
+	}
+
+	for _, test := range tests {
+		client := new(V2ClientSession)
+		client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+		client.SetSingleHostData(test.client)
+		server := new(V2ServerSession)
+		server.SetUserInfo("User", "Password", "Domain", "")
+		server.SetMachineID(test.server)
+
+		am, err := runV2Handshake(t, client, server, false)
+		if err != nil {
+			t.Fatalf("%s: could not authenticate: %s", test.name, err)
+		}
+		if server.IsLoopback() != test.loopback {
+			t.Errorf("%s: expected loopback %t", test.name, test.loopback)
+		}
+		if singleHost := am.NtlmV2Response.NtlmV2ClientChallenge.AvPairs.SingleHost(); (singleHost != nil) != (test.client != nil) {
+			t.Errorf("%s: Single_Host_Data should be sent: %t", test.name, test.client != nil)
+		}
+	}
+}
+
+func TestNTLMv2LoopbackRejectedMessage(t *testing.T) {
+	machineID := NewMachineID()
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	client.SetSingleHostData(&SingleHostData{MachineID: machineID})
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetMachineID(machineID)
+
+	am, err := runV2Handshake(t, client, server, false)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+	if !server.IsLoopback() {
+		t.Fatal("Client on the same host should be a loopback")
+	}
+
+	// The responses and Single_Host_Data are valid but the message is rejected because of its MIC
+	tampered, err := ParseAuthenticateMessage(am.Bytes(), 2)
+	if err != nil {
+		t.Fatalf("Could not parse authenticate message: %s", err)
+	}
+	tampered.Mic = make([]byte, 16)
+	err = server.ProcessAuthenticateMessage(tampered)
+	if !errors.Is(err, ErrMicMismatch) {
+		t.Fatalf("Expected MIC mismatch got %v", err)
+	}
+	if server.IsLoopback() {
+		t.Error("Rejected message should not mark the session as a loopback")
+	}
+}
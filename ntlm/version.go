@@ -16,7 +16,62 @@ type VersionStruct struct {
 	NTLMRevisionCurrent uint8
 }
 
+// The NTLMRevisionCurrent of all versions of Windows since Windows Server 2003
+const NTLMSSP_REVISION_W2K3 = uint8(0x0F)
+
+// The product names of the versions of Windows, builds that were released as both a client and a server edition
+// have both names
+var productNames = []struct {
+	major uint8
+	minor uint8
+	build uint16
+	name  string
+}{
+	{5, 1, 2600, "Windows XP"},
+	{5, 2, 3790, "Windows Server 2003"},
+	{6, 0, 6000, "Windows Vista"},
+	{6, 0, 6001, "Windows Vista SP1 / Windows Server 2008"},
+	{6, 0, 6002, "Windows Vista SP2 / Windows Server 2008 SP2"},
+	{6, 1, 7600, "Windows 7 / Windows Server 2008 R2"},
+	{6, 1, 7601, "Windows 7 SP1 / Windows Server 2008 R2 SP1"},
+	{6, 2, 9200, "Windows 8 / Windows Server 2012"},
+	{6, 3, 9600, "Windows 8.1 / Windows Server 2012 R2"},
+	{10, 0, 10240, "Windows 10 1507"},
+	{10, 0, 14393, "Windows 10 1607 / Windows Server 2016"},
+	{10, 0, 17763, "Windows 10 1809 / Windows Server 2019"},
+	{10, 0, 19041, "Windows 10 2004"},
+	{10, 0, 19045, "Windows 10 22H2"},
+	{10, 0, 20348, "Windows Server 2022"},
+	{10, 0, 22000, "Windows 11 21H2"},
+	{10, 0, 22621, "Windows 11 22H2"},
+	{10, 0, 26100, "Windows 11 24H2 / Windows Server 2025"},
+}
+
+// NewVersionStruct returns the VERSION of a product with the current NTLM revision
+func NewVersionStruct(major, minor uint8, build uint16) *VersionStruct {
+	return &VersionStruct{ProductMajorVersion: major, ProductMinorVersion: minor, ProductBuild: build, NTLMRevisionCurrent: NTLMSSP_REVISION_W2K3}
+}
+
+// The version sessions advertise unless another one is set, Windows 7 SP1
+func defaultVersion() *VersionStruct {
+	return NewVersionStruct(6, 1, 7601)
+}
+
+// ProductName returns the name of the version of Windows, or an empty string for versions that are not known
+func (v *VersionStruct) ProductName() string {
+	for _, product := range productNames {
+		if product.major == v.ProductMajorVersion && product.minor == v.ProductMinorVersion && product.build == v.ProductBuild {
+			return product.name
+		}
+	}
+	return ""
+}
+
 func ReadVersionStruct(structSource []byte) (*VersionStruct, error) {
+	if len(structSource) < 8 {
+		return nil, newError(ErrMalformedMessage, "VERSION structure must be 8 bytes")
+	}
+
 	versionStruct := new(VersionStruct)
 
 	versionStruct.ProductMajorVersion = uint8(structSource[0])
@@ -29,6 +84,9 @@ func ReadVersionStruct(structSource []byte) (*VersionStruct, error) {
 }
 
 func (v *VersionStruct) String() string {
+	if name := v.ProductName(); name != "" {
+		return fmt.Sprintf("%s (%d) Ntlm %d", name, v.ProductBuild, v.NTLMRevisionCurrent)
+	}
 	return fmt.Sprintf("%d.%d.%d Ntlm %d", v.ProductMajorVersion, v.ProductMinorVersion, v.ProductBuild, v.NTLMRevisionCurrent)
 }
 
@@ -44,3 +102,20 @@ func (v *VersionStruct) Bytes() []byte {
 
 	return buffer.Bytes()
 }
+
+// SetProductVersion sets the VERSION the session sends in its messages when NTLMSSP_NEGOTIATE_VERSION is negotiated.
+// The default is Windows 7 SP1, servers use the Version of their ServerConfig unless this is set.
+func (n *SessionData) SetProductVersion(version *VersionStruct) {
+	n.productVersion = version
+}
+
+// Returns the VERSION the session advertises
+func (n *SessionData) localVersion() *VersionStruct {
+	if n.productVersion != nil {
+		return n.productVersion
+	}
+	if n.serverConfig != nil && n.serverConfig.Version != nil {
+		return n.serverConfig.Version
+	}
+	return defaultVersion()
+}
@@ -0,0 +1,64 @@
+//Copyright 2013 Thomson Reuters Global Resources. BSD License please see License file for more information
+
+package ntlm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVersionProductName(t *testing.T) {
+	v := NewVersionStruct(10, 0, 20348)
+	if v.ProductName() != "Windows Server 2022" || v.String() != "Windows Server 2022 (20348) Ntlm 15" {
+		t.Errorf("Version name is not correct got %s", v)
+	}
+
+	v = NewVersionStruct(10, 0, 12345)
+	if v.ProductName() != "" || v.String() != "10.0.12345 Ntlm 15" {
+		t.Errorf("Unknown version should not have a name got %s", v)
+	}
+}
+
+func TestNTLMv2ProductVersion(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	client.SetProductVersion(NewVersionStruct(10, 0, 19045))
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetProductVersion(NewVersionStruct(10, 0, 17763))
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate: %s", err)
+	}
+	if am.Version == nil || am.Version.ProductBuild != 19045 {
+		t.Errorf("Client should send its version got %v", am.Version)
+	}
+	if server.challengeMessage.Version.ProductName() != "Windows 10 1809 / Windows Server 2019" {
+		t.Errorf("Server should send its version got %s", server.challengeMessage.Version)
+	}
+}
+
+func TestNTLMv2WithoutVersion(t *testing.T) {
+	client := new(V2ClientSession)
+	client.SetUserInfo("User", "Password", "Domain", "COMPUTER")
+	client.SetRequestedFlags(NTLMSSP_NEGOTIATE_VERSION.Unset(defaultV2ClientFlags()))
+	server := new(V2ServerSession)
+	server.SetUserInfo("User", "Password", "Domain", "")
+	server.SetServerCapabilities(NTLMSSP_NEGOTIATE_VERSION.Unset(defaultV2ServerFlags()))
+
+	am, err := runV2Handshake(t, client, server, true)
+	if err != nil {
+		t.Fatalf("Could not authenticate without a version: %s", err)
+	}
+	if am.Version != nil || server.challengeMessage.Version != nil {
+		t.Error("Version should only be sent when NTLMSSP_NEGOTIATE_VERSION is negotiated")
+	}
+	if am.micOffset != 72 || len(am.Mic) != 16 {
+		t.Errorf("MIC should follow the zero version field, got offset %d", am.micOffset)
+	}
+	challenge := server.challengeMessage.Bytes()
+	if len(challenge) != 56+int(server.challengeMessage.TargetInfoPayloadStruct.Len) || !bytes.Equal(challenge[48:56], zeroBytes(8)) {
+		t.Error("Challenge message should have a zero version field")
+	}
+}